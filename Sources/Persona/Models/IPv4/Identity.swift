@@ -14,6 +14,14 @@ import Net
 
 public struct Identity
 {
+    // The router tags every identity with its address family, so that it can carry both IPv4 and IPv6 identities.
+    // Persona only handles IPv4 packets, so it only ever sends IPv4 identities.
+    static public let familyIPv4: UInt8 = 4
+    static public let familyIPv6: UInt8 = 6
+
+    static public let ipv4Length: Int = 13
+    static public let ipv6Length: Int = 37
+
     public var data: Data
     {
         let localHostBytes = self.localAddress.data
@@ -30,7 +38,7 @@ public struct Identity
             return Data()
         }
 
-        return localHostBytes + localPortBytes + remoteHostBytes + remotePortBytes
+        return Data(array: [Identity.familyIPv4]) + localHostBytes + localPortBytes + remoteHostBytes + remotePortBytes
     }
 
     public let localAddress: IPv4Address
@@ -78,15 +86,27 @@ public struct Identity
 
     public init(data: Data) throws
     {
-        guard data.count == 12 else
+        let data = Data(data)
+
+        guard data.count > 0 else
+        {
+            throw IdentityError.badIdentity
+        }
+
+        guard data[0] == Identity.familyIPv4 else
+        {
+            throw IdentityError.unsupportedAddressFamily(data[0])
+        }
+
+        guard data.count == Identity.ipv4Length else
         {
             throw IdentityError.badIdentity
         }
 
-        let localAdddressBytes = Data(data[0..<4])
-        let localPortBytes = Data(data[4..<6])
-        let remoteAdddressBytes = Data(data[6..<10])
-        let remotePortBytes = Data(data[10..<12])
+        let localAdddressBytes = Data(data[1..<5])
+        let localPortBytes = Data(data[5..<7])
+        let remoteAdddressBytes = Data(data[7..<11])
+        let remotePortBytes = Data(data[11..<13])
 
         guard let localAddress = IPv4Address(data: localAdddressBytes) else
         {
@@ -107,6 +127,40 @@ public struct Identity
 
         self.init(localAddress: localAddress, localPort: localPort, remoteAddress: remoteAddress, remotePort: remotePort)
     }
+
+    // Splits an identity off the front of a message from the router, and returns it along with the rest of the message.
+    static public func split(_ data: Data) throws -> (Identity, Data)
+    {
+        let data = Data(data)
+
+        guard data.count > 0 else
+        {
+            throw IdentityError.badIdentity
+        }
+
+        let length: Int
+        switch data[0]
+        {
+            case Identity.familyIPv4:
+                length = Identity.ipv4Length
+
+            case Identity.familyIPv6:
+                length = Identity.ipv6Length
+
+            default:
+                throw IdentityError.badIdentity
+        }
+
+        guard data.count >= length else
+        {
+            throw IdentityError.badIdentity
+        }
+
+        let identity = try Identity(data: Data(data[0..<length]))
+        let rest = Data(data[length...])
+
+        return (identity, rest)
+    }
 }
 
 extension Identity: Equatable
@@ -139,4 +193,5 @@ extension Identity: CustomStringConvertible
 public enum IdentityError: Error
 {
     case badIdentity
+    case unsupportedAddressFamily(UInt8)
 }
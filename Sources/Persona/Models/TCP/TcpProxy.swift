@@ -98,6 +98,9 @@ public enum TcpProxyResponseType: UInt8, CustomStringConvertible
 
             case .ResponseConnectFailure:
                 return "FAILURE"
+
+            case .ResponseReset:
+                return "RESET"
         }
     }
 
@@ -106,6 +109,7 @@ public enum TcpProxyResponseType: UInt8, CustomStringConvertible
     case ResponseError = 3
     case ResponseConnectSuccess = 4
     case ResponseConnectFailure = 5
+    case ResponseReset = 6
 }
 
 public struct TcpProxyResponse: CustomStringConvertible
@@ -144,21 +148,19 @@ public struct TcpProxyResponse: CustomStringConvertible
 
     public init(data: Data) throws
     {
-        guard data.count >= 13 else
+        guard data.count >= 1 + Identity.ipv4Length else
         {
             throw TcpProxyError.shortMessage
         }
 
         let typeByte = data[0]
-        let identityBytes = Data(data[1..<13])
-        let rest = Data(data[13...])
 
         guard let type = TcpProxyResponseType(rawValue: typeByte) else
         {
             throw TcpProxyError.badMessage
         }
 
-        let identity = try Identity(data: identityBytes)
+        let (identity, rest) = try Identity.split(Data(data[1...]))
 
         switch type
         {
@@ -176,6 +178,9 @@ public struct TcpProxyResponse: CustomStringConvertible
 
             case .ResponseConnectFailure:
                 self.init(type: type, identity: identity)
+
+            case .ResponseReset:
+                self.init(type: type, identity: identity)
         }
     }
 }
@@ -232,6 +237,9 @@ public actor TcpProxy
 
             case .ResponseConnectFailure:
                 try await self.processUpstreamConnectFailure(identity: message.identity)
+
+            case .ResponseReset:
+                self.processUpstreamReset(identity: message.identity)
         }
     }
 
@@ -243,6 +251,13 @@ public actor TcpProxy
         self.logger.debug(">🕕> \(message) \(Date().timeIntervalSince1970)")
         #endif
 
+        // Persona only sets retransmission timers.
+        guard message.kind == .KindRetransmission else
+        {
+            self.logger.error("TcpProxy.handleTimerMessage - unexpected \(message.kind) timer")
+            return
+        }
+
         try await self.processTimeout(identity: message.identity, lowerBound: message.sequenceNumber)
     }
 
@@ -300,6 +315,11 @@ public actor TcpProxy
         try await TcpProxyConnection.close(identity: identity)
     }
 
+    public func processUpstreamReset(identity: Identity)
+    {
+        TcpProxyConnection.reset(identity: identity)
+    }
+
     public func processTimeout(identity: Identity, lowerBound: SequenceNumber) async throws
     {
         let connection = try TcpProxyConnection.getConnection(identity: identity)
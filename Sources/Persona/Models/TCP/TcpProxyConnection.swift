@@ -112,6 +112,12 @@ public actor TcpProxyConnection
             try await connection.state.close()
         }
     }
+
+    // The upstream connection was reset, so the tcpproxy subsystem has already forgotten it. There is nothing left to close.
+    static public func reset(identity: Identity)
+    {
+        self.removeConnection(identity: identity)
+    }
     // End of static section
 
     public let identity: Identity
@@ -15,11 +15,63 @@ import Net
 import Puppy
 import TransmissionAsync
 
+public enum TcpTimerOperation: UInt8, CustomStringConvertible
+{
+    public var description: String
+    {
+        switch self
+        {
+            case .OperationSet:
+                return "SET"
+
+            case .OperationReset:
+                return "RESET"
+
+            case .OperationCancel:
+                return "CANCEL"
+        }
+    }
+
+    case OperationSet = 1
+    case OperationReset = 2
+    case OperationCancel = 3
+}
+
+public enum TcpTimerKind: UInt8, CustomStringConvertible
+{
+    public var description: String
+    {
+        switch self
+        {
+            case .KindRetransmission:
+                return "retransmission"
+
+            case .KindDelayedAck:
+                return "delayed ack"
+
+            case .KindPersist:
+                return "persist"
+
+            case .KindKeepalive:
+                return "keepalive"
+
+            case .KindTimeWait:
+                return "time wait"
+        }
+    }
+
+    case KindRetransmission = 1
+    case KindDelayedAck = 2
+    case KindPersist = 3
+    case KindKeepalive = 4
+    case KindTimeWait = 5
+}
+
 public struct TcpProxyTimerRequest: CustomStringConvertible
 {
     public var description: String
     {
-        return "[TCP Timer Request \(self.identity):\(self.sequenceNumber)]"
+        return "[TCP Timer Request \(self.operation) \(self.kind) \(self.identity):\(self.sequenceNumber), \(self.milliseconds)ms]"
     }
 
     public var data: Data
@@ -40,16 +92,25 @@ public struct TcpProxyTimerRequest: CustomStringConvertible
             lowerBoundBytes = Data(repeating: 0, count: 4)
         }
 
-        return typeBytes + identityBytes + lowerBoundBytes
+        let operationBytes = Data(array: [self.operation.rawValue, self.kind.rawValue])
+        let durationBytes = self.milliseconds.maybeNetworkData ?? Data(repeating: 0, count: 4)
+
+        return typeBytes + identityBytes + operationBytes + durationBytes + lowerBoundBytes
     }
 
     let identity: Identity
     let sequenceNumber: SequenceNumber
+    let operation: TcpTimerOperation
+    let kind: TcpTimerKind
+    let milliseconds: UInt32 // 0 asks the router for its default duration
 
-    public init(identity: Identity, sequenceNumber: SequenceNumber)
+    public init(identity: Identity, sequenceNumber: SequenceNumber, operation: TcpTimerOperation = .OperationSet, kind: TcpTimerKind = .KindRetransmission, milliseconds: UInt32 = 0)
     {
         self.identity = identity
         self.sequenceNumber = sequenceNumber
+        self.operation = operation
+        self.kind = kind
+        self.milliseconds = milliseconds
     }
 }
 
@@ -57,31 +118,42 @@ public struct TcpProxyTimerResponse: CustomStringConvertible
 {
     public var description: String
     {
-        return "[TCP Timer Response \(self.identity):\(self.sequenceNumber)]"
+        return "[TCP Timer Response \(self.kind) \(self.identity):\(self.sequenceNumber)]"
     }
 
     let identity: Identity
+    let kind: TcpTimerKind
     let sequenceNumber: SequenceNumber
 
-    public init(identity: Identity, sequenceNumber: SequenceNumber)
+    public init(identity: Identity, kind: TcpTimerKind, sequenceNumber: SequenceNumber)
     {
         self.identity = identity
+        self.kind = kind
         self.sequenceNumber = sequenceNumber
     }
 
     public init(data: Data) throws
     {
-        guard data.count >= 16 else
+        guard data.count >= Identity.ipv4Length + 5 else
+        {
+            throw TcpProxyError.shortMessage
+        }
+
+        let (identity, rest) = try Identity.split(data)
+
+        // [4 byte lower bound][1 byte kind]
+        guard rest.count >= 5 else
         {
             throw TcpProxyError.shortMessage
         }
 
-        let identityBytes = Data(data[0..<12])
-        let rest = Data(data[12...])
+        let sequenceNumber = SequenceNumber(data: Data(rest[0..<4]))
 
-        let identity = try Identity(data: identityBytes)
-        let sequenceNumber = SequenceNumber(data: rest)
+        guard let kind = TcpTimerKind(rawValue: rest[4]) else
+        {
+            throw TcpProxyError.badMessage
+        }
 
-        self.init(identity: identity, sequenceNumber: sequenceNumber)
+        self.init(identity: identity, kind: kind, sequenceNumber: sequenceNumber)
     }
 }
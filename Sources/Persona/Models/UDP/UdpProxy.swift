@@ -77,13 +77,55 @@ public enum UdpProxyResponseType: UInt8, CustomStringConvertible
             case .ResponseData:
                 return "DATA"
 
+            case .ResponseClose:
+                return "CLOSE"
+
             case .ResponseError:
                 return "ERROR"
+
+            case .ResponseDataFrom:
+                return "DATA FROM"
+
+            case .ResponseUnreachable:
+                return "UNREACHABLE"
         }
     }
 
     case ResponseData = 1
+    case ResponseClose = 2
     case ResponseError = 3
+    case ResponseDataFrom = 4
+    case ResponseUnreachable = 5
+}
+
+public enum UdpProxyUnreachableReason: UInt8, CustomStringConvertible
+{
+    public var description: String
+    {
+        switch self
+        {
+            case .Unknown:
+                return "unknown"
+
+            case .Port:
+                return "port unreachable"
+
+            case .Host:
+                return "host unreachable"
+
+            case .Network:
+                return "network unreachable"
+
+            case .MessageTooBig:
+                return "message too big"
+        }
+    }
+
+    case Unknown = 0
+    case Port = 1
+    case Host = 2
+    case Network = 3
+    case MessageTooBig = 4
 }
 
 public struct UdpProxyResponse: CustomStringConvertible
@@ -122,29 +164,36 @@ public struct UdpProxyResponse: CustomStringConvertible
 
     public init(data: Data) throws
     {
-        guard data.count >= 13 else
+        guard data.count >= 1 + Identity.ipv4Length else
         {
             throw UdpProxyError.shortMessage
         }
 
         let typeByte = data[0]
-        let identityBytes = Data(data[1..<13])
-        let rest = Data(data[13...])
 
         guard let type = UdpProxyResponseType(rawValue: typeByte) else
         {
             throw UdpProxyError.badMessage
         }
 
-        let identity = try Identity(data: identityBytes)
+        let (identity, rest) = try Identity.split(Data(data[1...]))
 
         switch type
         {
             case .ResponseData:
                 self.init(type: type, identity: identity, payload: rest)
 
+            case .ResponseClose:
+                self.init(type: type, identity: identity)
+
             case .ResponseError:
                 self.init(type: type, identity: identity, error: UdpProxyError.frontendError(rest.string))
+
+            case .ResponseDataFrom:
+                self.init(type: type, identity: identity, payload: rest)
+
+            case .ResponseUnreachable:
+                self.init(type: type, identity: identity, payload: rest)
         }
     }
 }
@@ -188,8 +237,33 @@ public class UdpProxy
 
                 try await self.processUpstreamData(identity: message.identity, data: data)
 
+            case .ResponseClose:
+                // Persona keeps no state for UDP flows, so there is nothing to clean up. The next datagram from the client opens a new flow.
+                #if DEBUG
+                self.logger.debug("UdpProxy.handleMessage - the router closed the flow for \(message.identity)")
+                #endif
+
             case .ResponseError:
                 self.logger.error("UdpProxy.handleMessage - error: \(message.error?.localizedDescription ?? "none")")
+
+            case .ResponseDataFrom:
+                guard let data = message.payload else
+                {
+                    throw UdpProxyError.badMessage
+                }
+
+                try await self.processUpstreamDataFrom(identity: message.identity, data: data)
+
+            case .ResponseUnreachable:
+                guard let payload = message.payload, payload.count == 1 else
+                {
+                    throw UdpProxyError.badMessage
+                }
+
+                let reason = UdpProxyUnreachableReason(rawValue: Data(payload)[0]) ?? .Unknown
+
+                // Persona can't build ICMP packets yet, so the client isn't told. It will time out on its own.
+                self.logger.info("UdpProxy.handleMessage - \(message.identity) is unreachable: \(reason)")
         }
     }
 
@@ -205,6 +279,41 @@ public class UdpProxy
         try await self.downstream.writeWithLengthPrefix(message.data, 32)
     }
 
+    // In full cone mode the router also relays datagrams from remotes other than the identity's destination.
+    // The data starts with the remote's address, tagged with its address family, followed by the datagram.
+    public func processUpstreamDataFrom(identity: Identity, data: Data) async throws
+    {
+        let data = Data(data)
+
+        guard data.count >= 7 else
+        {
+            throw UdpProxyError.shortMessage
+        }
+
+        guard data[0] == Identity.familyIPv4 else
+        {
+            // The client only speaks IPv4, so there is no way to deliver a datagram from an IPv6 remote.
+            #if DEBUG
+            self.logger.debug("UdpProxy.processUpstreamDataFrom - dropping a datagram from an IPv6 remote")
+            #endif
+            return
+        }
+
+        guard let remoteAddress = IPv4Address(data: Data(data[1..<5])) else
+        {
+            throw UdpProxyError.invalidAddress(Data(data[1..<5]))
+        }
+
+        guard let remotePort = Data(data[5..<7]).maybeNetworkUint16 else
+        {
+            throw UdpProxyError.invalidAddress(Data(data[5..<7]))
+        }
+
+        let remoteIdentity = Identity(localAddress: identity.localAddress, localPort: identity.localPort, remoteAddress: remoteAddress, remotePort: remotePort)
+
+        try await self.processUpstreamData(identity: remoteIdentity, data: Data(data[7...]))
+    }
+
     public func processUpstreamData(identity: Identity, data: Data) async throws
     {
         guard data.count > 0 else
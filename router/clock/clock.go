@@ -0,0 +1,53 @@
+package clock
+
+import "time"
+
+/*
+Everything in the router that depends on the passage of time gets the time from a Clock, rather than calling the time
+package directly. In production this is Real, which is just the time package. Fake is a clock that only moves when it
+is told to, so that timer expiry, idle cleanup and retry delays can be driven without waiting for them.
+*/
+
+type Clock interface {
+	Now() time.Time
+
+	// After returns a channel that receives the time once d has passed, like time.After.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker returns a ticker that ticks every d, like time.NewTicker. Like a real ticker, it drops ticks if the
+	// receiver falls behind.
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
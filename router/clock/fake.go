@@ -0,0 +1,148 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Fake is a Clock whose time only changes when Advance is called. Advance fires every After channel and ticker that has
+come due, in the same way as the real clock would have done over that time, except that a ticker that has missed
+several ticks only delivers one of them, with the current time.
+*/
+
+type Fake struct {
+	lock    sync.Mutex
+	changed *sync.Cond // broadcast whenever the number of waiters or tickers changes
+	now     time.Time
+	waiters []*fakeWaiter
+	tickers []*fakeTicker
+}
+
+type fakeWaiter struct {
+	due     time.Time
+	channel chan time.Time
+}
+
+type fakeTicker struct {
+	clock   *Fake
+	period  time.Duration
+	next    time.Time
+	channel chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	fake := &Fake{now: now, waiters: make([]*fakeWaiter, 0), tickers: make([]*fakeTicker, 0)}
+	fake.changed = sync.NewCond(&fake.lock)
+
+	return fake
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	waiter := &fakeWaiter{f.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		waiter.channel <- f.now
+		return waiter.channel
+	}
+
+	f.waiters = append(f.waiters, waiter)
+	f.changed.Broadcast()
+
+	return waiter.channel
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for clock.Fake.NewTicker")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ticker := &fakeTicker{f, d, f.now.Add(d), make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, ticker)
+	f.changed.Broadcast()
+
+	return ticker
+}
+
+// Advance moves the clock forward by d and fires everything that has come due.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+
+	waiting := make([]*fakeWaiter, 0)
+	for _, waiter := range f.waiters {
+		if waiter.due.After(f.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+
+		waiter.channel <- f.now
+	}
+	f.waiters = waiting
+	f.changed.Broadcast()
+
+	for _, ticker := range f.tickers {
+		if ticker.next.After(f.now) {
+			continue
+		}
+
+		for !ticker.next.After(f.now) {
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+
+		select {
+		case ticker.channel <- f.now:
+		default:
+		}
+	}
+}
+
+// Waiting returns the number of After channels and tickers that are still waiting to fire.
+func (f *Fake) Waiting() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.waiters) + len(f.tickers)
+}
+
+// BlockUntil waits until exactly n After channels and tickers are waiting to fire. Tests use it to wait until the code
+// under test has started waiting, before calling Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for len(f.waiters)+len(f.tickers) != n {
+		f.changed.Wait()
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.channel
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for index, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:index], t.clock.tickers[index+1:]...)
+			t.clock.changed.Broadcast()
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfter(t *testing.T) {
+	fake := NewFake(time.Unix(1000, 0))
+	fired := fake.After(time.Second)
+
+	fake.Advance(time.Second - time.Nanosecond)
+	select {
+	case <-fired:
+		t.Fatal("After fired early")
+	default:
+	}
+
+	fake.Advance(time.Nanosecond)
+	select {
+	case now := <-fired:
+		if !now.Equal(time.Unix(1001, 0)) {
+			t.Errorf("expected After to fire at %v, got %v", time.Unix(1001, 0), now)
+		}
+	default:
+		t.Fatal("After did not fire")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	fake := NewFake(time.Unix(1000, 0))
+	ticker := fake.NewTicker(time.Second)
+
+	// A ticker that has missed several ticks only delivers one.
+	fake.Advance(3 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("expected missed ticks to be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	if fake.Waiting() != 0 {
+		t.Errorf("expected nothing to be waiting after Stop, got %d", fake.Waiting())
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	fake := NewFake(time.Unix(1000, 0))
+
+	fired := make(chan time.Time)
+	go func() {
+		fired <- <-fake.After(time.Second)
+	}()
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Second)
+	<-fired
+
+	fake.BlockUntil(0)
+}
@@ -1,58 +1,139 @@
 package ip
 
 import (
+	"encoding/binary"
 	"errors"
 	"strings"
 )
 
+/*
+An identity is encoded as an address family byte followed by the source and destination addresses.
+Each address is the host in network byte order followed by a big endian 2 byte port.
+
+	IPv4: [4][4 byte source host][2 byte source port][4 byte destination host][2 byte destination port] - 13 bytes
+	IPv6: [6][16 byte source host][2 byte source port][16 byte destination host][2 byte destination port] - 37 bytes
+*/
+
+type AddressFamily byte
+
+const (
+	IPv4 AddressFamily = 4
+	IPv6 AddressFamily = 6
+)
+
 type Identity struct {
+	Family      AddressFamily
 	Data        []byte
 	Source      string
 	Destination string
 }
 
+// IdentityLength returns the number of bytes used to encode an identity of the given address family, including the family byte.
+func IdentityLength(family AddressFamily) int {
+	addressLength := AddressLength(family)
+	if addressLength == 0 {
+		return 0
+	}
+
+	return 1 + 2*addressLength
+}
+
 func NewIdentity(data []byte) *Identity {
-	if len(data) != 12 {
+	if len(data) < 1 {
+		return nil
+	}
+
+	family := AddressFamily(data[0])
+	length := IdentityLength(family)
+	if length == 0 || len(data) != length {
 		return nil
 	}
 
-	sourceBytes := data[:6]
-	destinationBytes := data[6:]
+	addressLength := AddressLength(family)
+	sourceBytes := data[1 : 1+addressLength]
+	destinationBytes := data[1+addressLength:]
 
 	source := AddressBytesToString(sourceBytes)
 	destination := AddressBytesToString(destinationBytes)
 
-	return &Identity{data, source, destination}
+	return &Identity{family, data, source, destination}
 }
 
-func NewIdentityFromString(identityString string) (*Identity, error) {
-	parts := strings.Split(identityString, ":")
-	if len(parts) != 4 {
-		return nil, errors.New("error, identity string did not contain the right number of : separators")
+// SplitIdentity decodes the identity at the start of data and returns it along with the remaining bytes.
+// If data does not start with a valid identity then the returned identity is nil.
+func SplitIdentity(data []byte) (*Identity, []byte) {
+	if len(data) < 1 {
+		return nil, nil
+	}
+
+	length := IdentityLength(AddressFamily(data[0]))
+	if length == 0 || len(data) < length {
+		return nil, nil
 	}
 
-	sourceAddressString := parts[0]
-	sourcePortString := parts[1]
-	destinationAddressString := parts[2]
-	destinationPortString := parts[3]
+	return NewIdentity(data[:length]), data[length:]
+}
 
-	sourceBytes, sourceError := StringToAddressBytes(sourceAddressString + ":" + sourcePortString)
+// NewIdentityFromString parses an identity in the form source:port:destination:port.
+// IPv6 hosts must be enclosed in brackets, for instance [::1]:1234:[2001:db8::1]:443.
+func NewIdentityFromString(identityString string) (*Identity, error) {
+	sourceString, destinationString, splitError := splitIdentityString(identityString)
+	if splitError != nil {
+		return nil, splitError
+	}
+
+	sourceFamily, sourceBytes, sourceError := StringToAddressBytes(sourceString)
 	if sourceError != nil {
 		return nil, sourceError
 	}
 
-	destinationBytes, destinationError := StringToAddressBytes(destinationAddressString + ":" + destinationPortString)
+	destinationFamily, destinationBytes, destinationError := StringToAddressBytes(destinationString)
 	if destinationError != nil {
 		return nil, destinationError
 	}
 
+	if sourceFamily != destinationFamily {
+		return nil, errors.New("error, identity source and destination are from different address families")
+	}
+
 	identityBytes := make([]byte, 0)
+	identityBytes = append(identityBytes, byte(sourceFamily))
 	identityBytes = append(identityBytes, sourceBytes...)
 	identityBytes = append(identityBytes, destinationBytes...)
 	identity := NewIdentity(identityBytes)
 	return identity, nil
 }
 
+// DestinationPort returns the port from the end of the destination address.
+func (i *Identity) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(i.Data[len(i.Data)-2:])
+}
+
 func (i *Identity) String() string {
 	return i.Source + ":" + i.Destination
 }
+
+// splitIdentityString finds the : that separates the source port from the destination host.
+func splitIdentityString(identityString string) (string, string, error) {
+	hostEnd := 0
+	if strings.HasPrefix(identityString, "[") {
+		hostEnd = strings.Index(identityString, "]")
+		if hostEnd < 0 {
+			return "", "", errors.New("error, identity string has an unterminated [ in the source address")
+		}
+	}
+
+	portSeparator := strings.Index(identityString[hostEnd:], ":")
+	if portSeparator < 0 {
+		return "", "", errors.New("error, identity string did not contain the right number of : separators")
+	}
+	portStart := hostEnd + portSeparator + 1
+
+	portEnd := strings.Index(identityString[portStart:], ":")
+	if portEnd < 0 {
+		return "", "", errors.New("error, identity string did not contain the right number of : separators")
+	}
+	portEnd = portStart + portEnd
+
+	return identityString[:portEnd], identityString[portEnd+1:], nil
+}
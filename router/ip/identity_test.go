@@ -0,0 +1,117 @@
+package ip
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIdentityRoundTrip(t *testing.T) {
+	tests := []struct {
+		identity string
+		family   AddressFamily
+		length   int
+	}{
+		{"10.0.0.1:5000:192.0.2.1:80", IPv4, 13},
+		{"[fd00::1]:5000:[2001:db8::1]:443", IPv6, 37},
+		{"[::1]:1:[::2]:65535", IPv6, 37},
+	}
+
+	for _, test := range tests {
+		identity, identityError := NewIdentityFromString(test.identity)
+		if identityError != nil {
+			t.Errorf("%s: %v", test.identity, identityError)
+			continue
+		}
+
+		if identity.Family != test.family || len(identity.Data) != test.length {
+			t.Errorf("%s: expected family %d and %d bytes, got family %d and %d bytes", test.identity, test.family, test.length, identity.Family, len(identity.Data))
+		}
+
+		if identity.String() != test.identity {
+			t.Errorf("%s: parsed as %s", test.identity, identity.String())
+		}
+
+		decoded := NewIdentity(identity.Data)
+		if decoded == nil || decoded.String() != test.identity {
+			t.Errorf("%s: decoded as %v", test.identity, decoded)
+		}
+	}
+}
+
+func TestNewIdentityRejects(t *testing.T) {
+	ipv4 := []byte{4, 10, 0, 0, 1, 0x13, 0x88, 192, 0, 2, 1, 0, 80}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"unknown family", append([]byte{5}, ipv4[1:]...)},
+		{"IPv6 family with IPv4 addresses", append([]byte{6}, ipv4[1:]...)},
+		{"too short", ipv4[:12]},
+		{"too long", append(append([]byte{}, ipv4...), 0)},
+		{"family byte only", []byte{4}},
+	}
+
+	for _, test := range tests {
+		if identity := NewIdentity(test.data); identity != nil {
+			t.Errorf("%s: expected nil, got %s", test.name, identity.String())
+		}
+	}
+}
+
+func TestNewIdentityFromStringRejects(t *testing.T) {
+	tests := []string{
+		"10.0.0.1:5000:[2001:db8::1]:443",
+		"[fd00::1]:5000:192.0.2.1:80",
+		"[fd00::1:5000:[2001:db8::1]:443",
+		"10.0.0.1:5000",
+		"10.0.0.1",
+		"10.0.0.1:5000:192.0.2.1:70000",
+	}
+
+	for _, test := range tests {
+		if identity, identityError := NewIdentityFromString(test); identityError == nil {
+			t.Errorf("%s: expected an error, got %s", test, identity.String())
+		}
+	}
+}
+
+func TestSplitIdentity(t *testing.T) {
+	ipv4, _ := NewIdentityFromString("10.0.0.1:5000:192.0.2.1:80")
+	ipv6, _ := NewIdentityFromString("[fd00::1]:5000:[2001:db8::1]:443")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		identity string
+		rest     []byte
+	}{
+		{"IPv4 alone", ipv4.Data, ipv4.String(), []byte{}},
+		{"IPv4 with trailing data", append(append([]byte{}, ipv4.Data...), 1, 2, 3), ipv4.String(), []byte{1, 2, 3}},
+		{"IPv6 with trailing data", append(append([]byte{}, ipv6.Data...), 9), ipv6.String(), []byte{9}},
+		{"IPv6 family with IPv4 length", append(append([]byte{6}, ipv4.Data[1:]...), 1, 2, 3), "", nil},
+		{"truncated", ipv4.Data[:5], "", nil},
+		{"unknown family", append([]byte{0}, ipv4.Data[1:]...), "", nil},
+		{"empty", nil, "", nil},
+	}
+
+	for _, test := range tests {
+		identity, rest := SplitIdentity(test.data)
+		if test.identity == "" {
+			if identity != nil {
+				t.Errorf("%s: expected nil, got %s", test.name, identity.String())
+			}
+			continue
+		}
+
+		if identity == nil || identity.String() != test.identity {
+			t.Errorf("%s: expected %s, got %v", test.name, test.identity, identity)
+			continue
+		}
+
+		if !bytes.Equal(rest, test.rest) {
+			t.Errorf("%s: expected the rest to be %x, got %x", test.name, test.rest, rest)
+		}
+	}
+}
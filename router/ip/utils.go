@@ -5,35 +5,58 @@ import (
 	"errors"
 	"net"
 	"strconv"
-	"strings"
 )
 
+// AddressLength returns the number of bytes used to encode a host and port for the given address family.
+func AddressLength(family AddressFamily) int {
+	switch family {
+	case IPv4:
+		return net.IPv4len + 2
+	case IPv6:
+		return net.IPv6len + 2
+	default:
+		return 0
+	}
+}
+
 func AddressBytesToString(data []byte) string {
-	hostBytes := data[0:4]
-	portBytes := data[4:6]
-	hostString := net.IP{hostBytes[0], hostBytes[1], hostBytes[2], hostBytes[3]}.String()
+	hostLength := len(data) - 2
+	hostBytes := data[:hostLength]
+	portBytes := data[hostLength:]
+	hostString := net.IP(hostBytes).String()
 	portString := strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))
-	return hostString + ":" + portString
+	return net.JoinHostPort(hostString, portString)
 }
 
-func StringToAddressBytes(input string) ([]byte, error) {
-	parts := strings.Split(input, ":")
-	if len(parts) != 2 {
-		return nil, errors.New("error, address did not contain : separator")
+func StringToAddressBytes(input string) (AddressFamily, []byte, error) {
+	hostString, portString, splitError := net.SplitHostPort(input)
+	if splitError != nil {
+		return 0, nil, splitError
 	}
 
-	hostString := parts[0]
-	portString := parts[1]
-
 	hostIP, resolveError := net.ResolveIPAddr("ip", hostString)
 	if resolveError != nil {
-		return nil, resolveError
+		return 0, nil, resolveError
+	}
+
+	var family AddressFamily
+	var hostBytes []byte
+	if ipv4 := hostIP.IP.To4(); ipv4 != nil {
+		family = IPv4
+		hostBytes = ipv4
+	} else if ipv6 := hostIP.IP.To16(); ipv6 != nil {
+		family = IPv6
+		hostBytes = ipv6
+	} else {
+		return 0, nil, errors.New("error, address is neither IPv4 nor IPv6")
 	}
-	hostBytes := hostIP.IP
 
 	portInt, portError := strconv.Atoi(portString)
 	if portError != nil {
-		return nil, portError
+		return 0, nil, portError
+	}
+	if portInt < 0 || portInt > 65535 {
+		return 0, nil, errors.New("error, port out of range")
 	}
 	portUint16 := uint16(portInt)
 	portBytes := make([]byte, 2)
@@ -42,5 +65,46 @@ func StringToAddressBytes(input string) ([]byte, error) {
 	result := make([]byte, 0)
 	result = append(result, hostBytes...)
 	result = append(result, portBytes...)
+	return family, result, nil
+}
+
+// StringToTaggedAddressBytes encodes a host and port as an address family byte followed by the host and port.
+func StringToTaggedAddressBytes(input string) ([]byte, error) {
+	family, addressBytes, addressError := StringToAddressBytes(input)
+	if addressError != nil {
+		return nil, addressError
+	}
+
+	result := make([]byte, 0)
+	result = append(result, byte(family))
+	result = append(result, addressBytes...)
+	return result, nil
+}
+
+// IPToTaggedAddressBytes encodes a host and port in the same way as StringToTaggedAddressBytes, without going through
+// a string.
+func IPToTaggedAddressBytes(hostIP net.IP, port int) ([]byte, error) {
+	var family AddressFamily
+	var hostBytes []byte
+	if ipv4 := hostIP.To4(); ipv4 != nil {
+		family = IPv4
+		hostBytes = ipv4
+	} else if ipv6 := hostIP.To16(); ipv6 != nil {
+		family = IPv6
+		hostBytes = ipv6
+	} else {
+		return nil, errors.New("error, address is neither IPv4 nor IPv6")
+	}
+
+	if port < 0 || port > 65535 {
+		return nil, errors.New("error, port out of range")
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+
+	result := make([]byte, 0)
+	result = append(result, byte(family))
+	result = append(result, hostBytes...)
+	result = append(result, portBytes...)
 	return result, nil
 }
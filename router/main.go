@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/gopacket/layers"
@@ -11,6 +12,9 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"router/tcpproxy"
+	"router/udpproxy"
+	"sync"
 )
 
 func main() {
@@ -25,6 +29,32 @@ func main() {
 	logpath := flag.String("logpath", home+"/Persona/router.log", "path for log file")
 	socket := flag.Bool("socket", false, "enable single-connection socket mode for testing, by default uses systemd mode instead")
 	writePcap := flag.Bool("writePcap", false, "write packets to .pcap file")
+	flag.DurationVar(&tcpproxy.DialTimeout, "dialTimeout", tcpproxy.DialTimeout, "time limit for each attempt to connect to an upstream TCP server")
+	flag.IntVar(&tcpproxy.DialAttempts, "dialAttempts", tcpproxy.DialAttempts, "number of attempts to connect to an upstream TCP server before giving up")
+	flag.DurationVar(&tcpproxy.DialRetryDelay, "dialRetryDelay", tcpproxy.DialRetryDelay, "time to wait between attempts to connect to an upstream TCP server")
+	flag.DurationVar(&tcpproxy.FallbackDelay, "happyEyeballsDelay", tcpproxy.FallbackDelay, "delay before trying the next address of an upstream TCP server with multiple addresses, negative to disable parallel dialing")
+	flag.DurationVar(&tcpproxy.KeepAlive, "tcpKeepAlive", tcpproxy.KeepAlive, "interval between TCP keepalive probes on upstream connections, negative to disable")
+	flag.BoolVar(&tcpproxy.NoDelay, "tcpNoDelay", tcpproxy.NoDelay, "set TCP_NODELAY on upstream connections")
+	flag.DurationVar(&tcpproxy.UserTimeout, "tcpUserTimeout", tcpproxy.UserTimeout, "TCP_USER_TIMEOUT for upstream connections, 0 for the OS default")
+	flag.BoolVar(&tcpproxy.FastOpenConnect, "tcpFastOpen", tcpproxy.FastOpenConnect, "set TCP_FASTOPEN_CONNECT on upstream connections that are opened with data")
+	flag.StringVar(&tcpproxy.CongestionControl, "tcpCongestionControl", tcpproxy.CongestionControl, "TCP congestion control algorithm for upstream connections, empty for the OS default")
+	flag.IntVar(&tcpproxy.DSCP, "dscp", tcpproxy.DSCP, "DSCP value to mark upstream TCP connections with, 0 for the OS default")
+	flag.IntVar(&tcpproxy.MinReadSize, "tcpMinReadSize", tcpproxy.MinReadSize, "smallest buffer in bytes to read from an upstream TCP connection into")
+	flag.IntVar(&tcpproxy.MaxReadSize, "tcpMaxReadSize", tcpproxy.MaxReadSize, "largest buffer in bytes to read from an upstream TCP connection into")
+	flag.DurationVar(&tcpproxy.ResolveCacheTTL, "resolveCacheTTL", tcpproxy.ResolveCacheTTL, "how long to cache hostnames resolved for clients")
+	flag.IntVar(&tcpproxy.ResolveCacheSize, "resolveCacheSize", tcpproxy.ResolveCacheSize, "maximum number of hostnames to cache, 0 to disable the cache")
+	flag.DurationVar(&tcpproxy.IdleTimeout, "tcpIdleTimeout", tcpproxy.IdleTimeout, "close upstream TCP connections that have been idle for this long, 0 to disable")
+	flag.DurationVar(&tcpproxy.CloseTimeout, "tcpCloseTimeout", tcpproxy.CloseTimeout, "time limit for writing out data that is still queued for an upstream TCP connection when it is closed")
+	flag.IntVar(&tcpproxy.MaxConnections, "tcpMaxConnections", tcpproxy.MaxConnections, "maximum number of upstream TCP connections per session, 0 for no limit")
+	flag.IntVar(&tcpproxy.SessionQueueBytes, "tcpSessionQueueBytes", tcpproxy.SessionQueueBytes, "maximum number of bytes waiting to be written to all of a session's upstream TCP connections together")
+	flag.BoolVar(&udpproxy.FullCone, "udpFullCone", udpproxy.FullCone, "deliver UDP datagrams from any remote, not just the original destination, for peer-to-peer protocols")
+	flag.DurationVar(&udpproxy.DefaultTimeout, "udpTimeout", udpproxy.DefaultTimeout, "close UDP flows that have been idle for this long, unless their port has its own timeout")
+	flag.IntVar(&udpproxy.MinReadSize, "udpMinReadSize", udpproxy.MinReadSize, "size in bytes of the buffers that UDP datagrams are first read into, flows switch to 64 KiB buffers after a larger datagram")
+	flag.IntVar(&udpproxy.BatchSize, "udpBatchSize", udpproxy.BatchSize, "maximum number of UDP datagrams to read or write with one system call")
+	flag.IntVar(&MaxFrameSize, "maxFrameSize", MaxFrameSize, "largest frame in bytes that the client or Persona may send, larger frames close the session")
+	flag.IntVar(&WriteBatchFrames, "writeBatchFrames", WriteBatchFrames, "maximum number of frames to write to the client or Persona with one system call")
+	udpPortTimeouts := flag.String("udpPortTimeouts", "", "comma separated list of port=duration UDP idle timeouts, for instance 53=10s,443=10m")
+	deniedNetworks := flag.String("denyNetworks", "", "comma separated list of networks in CIDR notation that clients may not connect to")
 	flag.Parse()
 
 	// If the file doesn't exist, create it or append to the file
@@ -40,6 +70,24 @@ func main() {
 		golog.SetLevel("error")
 	}
 
+	portTimeoutsError := udpproxy.SetPortTimeouts(*udpPortTimeouts)
+	if portTimeoutsError != nil {
+		golog.Errorf("error parsing udpPortTimeouts: %v", portTimeoutsError.Error())
+		os.Exit(15)
+	}
+
+	deniedNetworksError := tcpproxy.SetDeniedNetworks(*deniedNetworks)
+	if deniedNetworksError != nil {
+		golog.Errorf("error parsing denyNetworks: %v", deniedNetworksError.Error())
+		os.Exit(14)
+	}
+
+	socketOptionsError := tcpproxy.CheckSocketOptions()
+	if socketOptionsError != nil {
+		golog.Errorf("error checking tcp socket options: %v", socketOptionsError.Error())
+		os.Exit(16)
+	}
+
 	var pcapWriter *pcapgo.Writer
 	if *writePcap {
 		pcapFile, openError := os.OpenFile(home+"/Persona/persona.pcap", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
@@ -48,7 +96,7 @@ func main() {
 			pcapWriter = nil
 		} else {
 			pcapWriter = pcapgo.NewWriter(pcapFile)
-			pcapWriter.WriteFileHeader(65536, layers.LinkTypeIPv4) // new file, must do this.
+			pcapWriter.WriteFileHeader(65536, layers.LinkTypeRaw) // new file, must do this. Raw covers both IPv4 and IPv6 packets.
 			defer func() {
 				pcapFile.Close()
 			}()
@@ -77,7 +125,7 @@ func main() {
 			clientReader = connection
 			clientWriter = connection
 
-			go handleConnection(home, client, clientReader, clientWriter, pcapWriter)
+			go handleConnection(home, client, clientReader, clientWriter, pcapWriter, false)
 		}
 	} else {
 		systemd := os.NewFile(3, "systemd")
@@ -85,22 +133,48 @@ func main() {
 		clientReader = systemd
 		clientWriter = systemd
 
-		handleConnection(home, client, clientReader, clientWriter, pcapWriter)
+		// Use the socket as a network connection when possible, so that writes to the client can be vectored.
+		connection, fileConnError := net.FileConn(systemd)
+		if fileConnError == nil {
+			_ = systemd.Close()
+			client = connection
+			clientReader = connection
+			clientWriter = connection
+		} else {
+			golog.Debugf("systemd socket is not a network connection: %v", fileConnError.Error())
+		}
+
+		handleConnection(home, client, clientReader, clientWriter, pcapWriter, true)
 	}
 }
 
-func handleConnection(home string, client io.Closer, clientReader io.Reader, clientWriter io.Writer, pcapWriter *pcapgo.Writer) {
+// session is everything that belongs to one client connection. When exit is set the router serves only this session,
+// as it does under systemd, and exits along with it.
+type session struct {
+	client  io.Closer
+	cancel  context.CancelFunc
+	persona *exec.Cmd
+	router  *Router // nil until the router has been started
+	exit    bool
+	once    sync.Once
+}
+
+func handleConnection(home string, client io.Closer, clientReader io.Reader, clientWriter io.Writer, pcapWriter *pcapgo.Writer, exit bool) {
 	context, cancel := context.WithCancel(context.Background())
 	persona := exec.CommandContext(context, home+"/Persona/Persona")
+	current := &session{client: client, cancel: cancel, persona: persona, exit: exit}
+
 	personaInput, inputError := persona.StdinPipe()
 	if inputError != nil {
 		golog.Errorf("error getting Persona stdin: %v", inputError.Error())
-		os.Exit(12)
+		current.closeWithError("persona", inputError, 12)
+		return
 	}
 	personaOutput, outputError := persona.StdoutPipe()
 	if outputError != nil {
 		golog.Errorf("error getting Persona stdout: %v", outputError.Error())
-		os.Exit(13)
+		current.closeWithError("persona", outputError, 13)
+		return
 	}
 
 	persona.Start()
@@ -113,39 +187,66 @@ func handleConnection(home string, client io.Closer, clientReader io.Reader, cli
 	personaReadChannel := make(chan []byte)
 	personaWriteChannel := make(chan []byte)
 
-	clientToChannel := ReaderToChannel{"client", clientReader, "router", clientReadChannel, pcapWriter, func(closer string, closeError error) {
-		closeWithError(closer, closeError, 0, cancel, client)
-	}}
-	channelToClient := ChannelToWriter{"router", clientWriteChannel, "client", clientWriter, pcapWriter, func(closer string, closeError error) {
-		closeWithError(closer, closeError, 0, cancel, client)
-	}}
+	clientToChannel := ReaderToChannel{"client", clientReader, "router", clientReadChannel, pcapWriter}
+	channelToClient := ChannelToWriter{"router", clientWriteChannel, "client", clientWriter, pcapWriter}
 
-	personaToChannel := ReaderToChannel{"persona", personaOutput, "router", personaReadChannel, nil, func(closer string, closeError error) {
-		closeWithError(closer, closeError, 4, cancel, client)
-	}}
-	channelToPersona := ChannelToWriter{"router", personaWriteChannel, "persona", personaInput, nil, func(closer string, closeError error) {
-		closeWithError(closer, closeError, 5, cancel, client)
-	}}
+	personaToChannel := ReaderToChannel{"persona", personaOutput, "router", personaReadChannel, nil}
+	channelToPersona := ChannelToWriter{"router", personaWriteChannel, "persona", personaInput, nil}
+
+	router, routerError := NewRouter(clientReadChannel, clientWriteChannel, personaReadChannel, personaWriteChannel)
+	if routerError != nil {
+		current.closeWithError("router", routerError, 6)
+		return
+	}
+	// The router is set before any pump can fail, so that closing the session always stops it.
+	current.router = router
 
 	// Non-blocking
-	go clientToChannel.Pump()
-	go channelToClient.Pump()
+	go current.supervise(clientToChannel.Pump, 0)
+	go current.supervise(channelToClient.Pump, 0)
 
-	go personaToChannel.Pump()
-	go channelToPersona.Pump()
+	go current.supervise(personaToChannel.Pump, 4)
+	go current.supervise(channelToPersona.Pump, 5)
 
-	router, routerError := NewRouter(clientReadChannel, clientWriteChannel, personaReadChannel, personaWriteChannel)
-	if routerError != nil {
-		closeWithError("router", routerError, 6, cancel, client)
+	router.Route() // blocking until the session is closed
+
+	golog.Debug("session closed")
+}
+
+// supervise runs a pump, and closes the session with exitCode when the pump fails.
+func (s *session) supervise(pump func() error, exitCode int) {
+	pumpError := pump()
+	if pumpError == nil {
+		return
 	}
-	router.Route() // blocking
 
-	golog.Debug("exiting router abnormally, something isn't blocking")
+	closer := "router"
+	closeError := pumpError
+
+	var failure *PumpError
+	if errors.As(pumpError, &failure) {
+		closer = failure.Name
+		closeError = failure.Err
+	}
+
+	s.closeWithError(closer, closeError, exitCode)
 }
 
-func closeWithError(closer string, closeError error, exitCode int, cancel context.CancelFunc, client io.Closer) {
+// closeWithError stops Persona and the router, which closes every upstream connection, and closes the client. Only the
+// first failure in a session closes it.
+func (s *session) closeWithError(closer string, closeError error, exitCode int) {
 	golog.Debugf("Closing %s with an error: %v", closer, closeError.Error())
-	cancel()
-	_ = client.Close()
-	os.Exit(exitCode)
+
+	s.once.Do(func() {
+		s.cancel()
+		if s.router != nil {
+			s.router.Stop()
+		}
+		_ = s.client.Close()
+		_ = s.persona.Wait()
+
+		if s.exit {
+			os.Exit(exitCode)
+		}
+	})
 }
@@ -1,15 +1,47 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcapgo"
 	"github.com/kataras/golog"
 	"io"
+	"net"
 	"time"
 )
 
+// MaxFrameSize is the largest frame that the client or Persona may send. Each frame is a 4 byte big endian length
+// followed by the data, and a larger length closes the session, since the stream can't be resynchronized.
+var MaxFrameSize = 1024 * 1024 // 1 MiB
+
+// WriteBatchFrames is the most frames that ChannelToWriter writes at once, with one writev on a network connection.
+var WriteBatchFrames = 64
+
+const pumpBufferSize = 64 * 1024
+
+// maxFrameLength is the largest frame that can be described by the 4 byte length prefix.
+const maxFrameLength = 1<<32 - 1
+
+var ErrFrameTooLarge = errors.New("error, frame is too large")
+
+// PumpError is returned by Pump when a pump stops because one side of it has failed. Pumps never close anything
+// themselves, that is up to whoever runs them.
+type PumpError struct {
+	Name string // the name of the side that failed, the input of a ReaderToChannel or the output of a ChannelToWriter
+	Err  error
+}
+
+func (e *PumpError) Error() string {
+	return fmt.Sprintf("error, %s failed: %v", e.Name, e.Err)
+}
+
+func (e *PumpError) Unwrap() error {
+	return e.Err
+}
+
 type ReaderToChannel struct {
 	InputName string
 	Input     io.Reader
@@ -18,55 +50,40 @@ type ReaderToChannel struct {
 	Output     chan []byte
 
 	PcapWriter *pcapgo.Writer
-
-	Close func(string, error)
 }
 
-func (p ReaderToChannel) Pump() {
+// Pump reads frames until the input fails or closes, and returns a PumpError for the input.
+// Every frame that was read completely before then has been handed to Output by the time Pump returns.
+// Pump waits for the router to take each frame before reading the next, so a session that isn't being drained stops
+// being read.
+func (p ReaderToChannel) Pump() error {
+	// Small frames that arrive together are read with a single read.
+	input := bufio.NewReaderSize(p.Input, pumpBufferSize)
+
+	lengthBytes := make([]byte, 4)
 	for {
-		lengthBytes := make([]byte, 4)
-		lengthRead, lengthReadError := p.Input.Read(lengthBytes)
+		_, lengthReadError := io.ReadFull(input, lengthBytes)
 		if lengthReadError != nil {
-			p.Close(p.InputName, lengthReadError)
-			return
+			return &PumpError{p.InputName, lengthReadError}
 		}
 
-		totalLengthRead := lengthRead
-		for totalLengthRead < 4 {
-			buffer := make([]byte, 4-totalLengthRead)
-			lengthRead, lengthReadError = p.Input.Read(buffer)
-			if lengthReadError != nil {
-				p.Close(p.InputName, lengthReadError)
-				return
-			}
-			copy(lengthBytes[totalLengthRead:totalLengthRead+lengthRead], buffer[:lengthRead])
-			totalLengthRead = totalLengthRead + lengthRead
+		length := int(binary.BigEndian.Uint32(lengthBytes))
+		if length > MaxFrameSize {
+			frameError := fmt.Errorf("%w, %d bytes is larger than the maximum frame size of %d bytes", ErrFrameTooLarge, length, MaxFrameSize)
+			golog.Errorf("error reading from %v: %v", p.InputName, frameError.Error())
+			return &PumpError{p.InputName, frameError}
 		}
 
-		length := int(binary.BigEndian.Uint32(lengthBytes))
 		data := make([]byte, length)
-
-		totalLength := 0
-		for totalLength < length {
-			buffer := make([]byte, length-totalLength)
-			dataReadLength, dataReadError := p.Input.Read(buffer)
-			if dataReadLength > 0 {
-				copy(data[totalLength:totalLength+dataReadLength], buffer[:dataReadLength])
-				totalLength = totalLength + dataReadLength
-			}
-			if dataReadError != nil {
-				golog.Errorf("error reading from %v: %v", p.InputName, dataReadError.Error())
-				p.Close(p.InputName, dataReadError)
-				return
-			}
+		_, dataReadError := io.ReadFull(input, data)
+		if dataReadError != nil {
+			golog.Errorf("error reading from %v: %v", p.InputName, dataReadError.Error())
+			return &PumpError{p.InputName, dataReadError}
 		}
 
 		p.Output <- data
 
-		if p.PcapWriter != nil {
-			info := gopacket.CaptureInfo{time.Now(), len(data), len(data), 0, nil}
-			p.PcapWriter.WritePacket(info, data)
-		}
+		writePcap(p.PcapWriter, data)
 	}
 }
 
@@ -78,37 +95,150 @@ type ChannelToWriter struct {
 	Output     io.Writer
 
 	PcapWriter *pcapgo.Writer
-
-	Close func(string, error)
 }
 
-func (p ChannelToWriter) Pump() {
+// Pump writes frames until the output fails, and returns a PumpError for the output.
+// If Input is closed, Pump returns nil once everything before it has been written.
+func (p ChannelToWriter) Pump() error {
+	batchFrames := WriteBatchFrames
+	if batchFrames < 1 {
+		batchFrames = 1
+	}
+
+	// The length prefixes and the vector of buffers are reused for every batch.
+	lengths := make([]byte, 4*batchFrames)
+	frames := make([][]byte, 0, batchFrames)
+	vector := make(net.Buffers, 0, 2*batchFrames)
+
+	// net.Buffers only becomes a single system call when it is written to a network connection.
+	_, vectored := p.Output.(net.Conn)
+
+	var output *bufio.Writer
+	if !vectored {
+		output = bufio.NewWriterSize(p.Output, pumpBufferSize)
+	}
+
 	for {
-		data := <-p.Input
+		var open bool
+		frames, open = p.collect(frames[:0])
+
+		var writeError error
+		if vectored {
+			writeError = p.writeVector(frames, lengths, vector[:0])
+		} else {
+			writeError = p.writeBuffered(frames, lengths, output)
+		}
+
+		if writeError != nil {
+			golog.Errorf("error writing to %v: %v", p.OutputName, writeError.Error())
+			return &PumpError{p.OutputName, writeError}
+		}
 
-		length := len(data)
-		lengthBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(lengthBytes, uint32(length))
+		for index, data := range frames {
+			writePcap(p.PcapWriter, data)
+			frames[index] = nil
+		}
 
-		lengthWritten, lengthWriteError := p.Output.Write(lengthBytes)
-		if lengthWriteError != nil {
-			p.Close(p.OutputName, lengthWriteError)
+		if !open {
+			return nil
 		}
-		if lengthWritten != 4 {
-			p.Close(p.OutputName, errors.New("short write on length"))
+	}
+}
+
+// collect waits for a frame and then takes any others that are already waiting, until frames is full.
+// It returns false once Input has been closed, along with whatever frames came before that.
+func (p ChannelToWriter) collect(frames [][]byte) ([][]byte, bool) {
+	data, open := <-p.Input
+	if !open {
+		return frames, false
+	}
+	frames = append(frames, data)
+
+	for len(frames) < cap(frames) {
+		select {
+		case data, open = <-p.Input:
+			if !open {
+				return frames, false
+			}
+			frames = append(frames, data)
+		default:
+			return frames, true
 		}
+	}
 
-		dataWritten, dataWriteError := p.Output.Write(data)
-		if dataWriteError != nil {
-			p.Close(p.OutputName, dataWriteError)
+	return frames, true
+}
+
+// checkFrames makes sure that every frame in a batch can be written before any of them are, so that a batch is never
+// cut off part way through because of a frame that is too large.
+func checkFrames(frames [][]byte) error {
+	for _, data := range frames {
+		if uint64(len(data)) > maxFrameLength {
+			return fmt.Errorf("%w, %d bytes does not fit in the length prefix", ErrFrameTooLarge, len(data))
 		}
-		if dataWritten != length {
-			p.Close(p.OutputName, errors.New("short write on data"))
+	}
+
+	return nil
+}
+
+// writeVector writes a batch of frames to a network connection with one writev.
+func (p ChannelToWriter) writeVector(frames [][]byte, lengths []byte, vector net.Buffers) error {
+	checkError := checkFrames(frames)
+	if checkError != nil {
+		return checkError
+	}
+
+	total := int64(0)
+	for index, data := range frames {
+		length := lengths[4*index : 4*index+4]
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+
+		vector = append(vector, length, data)
+		total = total + 4 + int64(len(data))
+	}
+
+	written, writeError := vector.WriteTo(p.Output)
+	if writeError != nil {
+		return writeError
+	}
+	if written != total {
+		return fmt.Errorf("%w, wrote %d of %d bytes", io.ErrShortWrite, written, total)
+	}
+
+	return nil
+}
+
+// writeBuffered writes a batch of frames through output, and flushes it once at the end.
+// A bufio.Writer keeps the first error it sees and fails every write after it, so nothing follows a partial frame.
+func (p ChannelToWriter) writeBuffered(frames [][]byte, lengths []byte, output *bufio.Writer) error {
+	checkError := checkFrames(frames)
+	if checkError != nil {
+		return checkError
+	}
+
+	for index, data := range frames {
+		length := lengths[4*index : 4*index+4]
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+
+		_, lengthWriteError := output.Write(length)
+		if lengthWriteError != nil {
+			return lengthWriteError
 		}
 
-		if p.PcapWriter != nil {
-			info := gopacket.CaptureInfo{time.Now(), len(data), len(data), 0, nil}
-			p.PcapWriter.WritePacket(info, data)
+		_, dataWriteError := output.Write(data)
+		if dataWriteError != nil {
+			return dataWriteError
 		}
 	}
+
+	return output.Flush()
+}
+
+func writePcap(pcapWriter *pcapgo.Writer, data []byte) {
+	if pcapWriter == nil {
+		return
+	}
+
+	info := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	pcapWriter.WritePacket(info, data)
 }
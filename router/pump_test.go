@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+	defer listener.Close()
+
+	client, dialError := net.Dial("tcp", listener.Addr().String())
+	if dialError != nil {
+		t.Fatal(dialError)
+	}
+
+	server, acceptError := listener.Accept()
+	if acceptError != nil {
+		t.Fatal(acceptError)
+	}
+
+	return client, server
+}
+
+// TestFrameTooLarge checks that a frame that is too large stops the pump straight away, without waiting for the router.
+func TestFrameTooLarge(t *testing.T) {
+	pump := ReaderToChannel{"client", bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}), "router", make(chan []byte), nil}
+
+	pumpError := pump.Pump()
+
+	var failure *PumpError
+	if !errors.As(pumpError, &failure) || failure.Name != "client" || !errors.Is(pumpError, ErrFrameTooLarge) {
+		t.Fatalf("expected a PumpError for the client with ErrFrameTooLarge, got %v", pumpError)
+	}
+}
+
+// TestRoundTrip sends frames through a ChannelToWriter and back through a ReaderToChannel, over a network connection
+// so that the frames are written with writev, and over a pipe so that they go through a bufio.Writer.
+func TestRoundTrip(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	cases := []struct {
+		name   string
+		writer io.Writer
+		reader io.Reader
+	}{
+		{"vectored", client, server},
+		{"buffered", pipeWriter, pipeReader},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			input := make(chan []byte, 128)
+			output := make(chan []byte)
+
+			writer := ChannelToWriter{"router", input, "output", test.writer, nil}
+			reader := ReaderToChannel{"input", test.reader, "router", output, nil}
+
+			go func() {
+				_ = writer.Pump()
+			}()
+			go func() {
+				_ = reader.Pump()
+			}()
+
+			go func() {
+				for index := 0; index < 1000; index++ {
+					data := make([]byte, 4+index%100)
+					binary.BigEndian.PutUint32(data, uint32(index))
+					input <- data
+				}
+			}()
+
+			for index := 0; index < 1000; index++ {
+				data := <-output
+				if len(data) != 4+index%100 || binary.BigEndian.Uint32(data) != uint32(index) {
+					t.Fatalf("frame %d came back wrong", index)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReaderToChannel reads small frames from a loopback TCP connection. Each operation is one frame.
+func BenchmarkReaderToChannel(b *testing.B) {
+	client, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+
+	// The sender writes the frames 64 at a time, as ChannelToWriter would.
+	const frameSize = 100
+	chunk := make([]byte, 0)
+	for index := 0; index < 64; index++ {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, frameSize)
+		chunk = append(chunk, length...)
+		chunk = append(chunk, make([]byte, frameSize)...)
+	}
+
+	go func() {
+		for sent := 0; sent < b.N; sent += 64 {
+			if _, writeError := client.Write(chunk); writeError != nil {
+				return
+			}
+		}
+	}()
+
+	output := make(chan []byte, 64)
+	pump := ReaderToChannel{"client", server, "router", output, nil}
+	go func() {
+		_ = pump.Pump()
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(4 + frameSize)
+	b.ResetTimer()
+
+	for index := 0; index < b.N; index++ {
+		<-output
+	}
+}
+
+// BenchmarkChannelToWriter writes small frames to a loopback TCP connection with writev, and through a bufio.Writer to
+// an output that isn't a network connection. Each operation is one frame.
+func BenchmarkChannelToWriter(b *testing.B) {
+	const frameSize = 100
+	data := make([]byte, frameSize)
+
+	b.Run("vectored", func(b *testing.B) {
+		client, server := tcpPair(b)
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			_, _ = io.Copy(io.Discard, server)
+		}()
+
+		benchmarkChannelToWriter(b, client, data)
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkChannelToWriter(b, io.Discard, data)
+	})
+}
+
+func benchmarkChannelToWriter(b *testing.B, output io.Writer, data []byte) {
+	input := make(chan []byte, 64)
+	pump := ChannelToWriter{"router", input, "output", output, nil}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(4 + len(data)))
+	b.ResetTimer()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pump.Pump()
+	}()
+
+	for index := 0; index < b.N; index++ {
+		input <- data
+	}
+	close(input)
+
+	if pumpError := <-done; pumpError != nil {
+		b.Fatal(pumpError)
+	}
+}
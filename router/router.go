@@ -6,6 +6,7 @@ import (
 	"router/tcpproxy"
 	"router/timer"
 	"router/udpproxy"
+	"sync"
 	"time"
 )
 
@@ -21,6 +22,9 @@ type Router struct {
 	PersonaWriteChannel chan []byte
 
 	LastClientWrite time.Time
+
+	done    chan struct{} // closed by Stop
+	stopped sync.Once
 }
 
 func NewRouter(clientRead chan []byte, clientWrite chan []byte, personaRead chan []byte, personaWrite chan []byte) (*Router, error) {
@@ -46,36 +50,75 @@ func NewRouter(clientRead chan []byte, clientWrite chan []byte, personaRead chan
 	go timerProxy.Run()
 
 	now := time.Now()
+	done := make(chan struct{})
 
-	return &Router{tcp, udp, timerProxy, clientRead, clientWrite, personaRead, personaWrite, now}, nil
+	return &Router{tcp, udp, timerProxy, clientRead, clientWrite, personaRead, personaWrite, now, done, sync.Once{}}, nil
 }
 
+// Route routes messages until the router is stopped. It then closes the channels to the client and Persona, once
+// nothing else can send on them, so that the pumps writing them out can finish.
 func (r *Router) Route() {
-	go r.RoutePersona()
-	go r.RouteTcpproxy()
-	go r.RouteUdpproxy()
-	go r.RouteTimerProxy()
+	var routes sync.WaitGroup
+	for _, route := range []func(){r.RoutePersona, r.RouteTcpproxy, r.RouteUdpproxy, r.RouteTimerProxy} {
+		routes.Add(1)
+		go func(route func()) {
+			defer routes.Done()
+			route()
+		}(route)
+	}
 
 	r.RouteClient()
+	routes.Wait()
+
+	close(r.ClientWriteChannel)
+	close(r.PersonaWriteChannel)
+}
+
+// Stop stops the router and its proxies, which close all of the session's upstream connections.
+func (r *Router) Stop() {
+	r.stopped.Do(func() {
+		close(r.done)
+		r.Tcp.Stop()
+		r.Udp.Stop()
+		r.Timer.Stop()
+	})
+}
+
+// toPersona sends a message to Persona, unless the router has been stopped.
+func (r *Router) toPersona(message []byte) {
+	select {
+	case r.PersonaWriteChannel <- message:
+	case <-r.done:
+	}
 }
 
 func (r *Router) RouteClient() {
 	for {
 		// Received data from the client
-		clientData := <-r.ClientReadChannel
+		var clientData []byte
+		select {
+		case clientData = <-r.ClientReadChannel:
+		case <-r.done:
+			return
+		}
 		golog.Debugf("-> Client -> Persona message is %v bytes: %x", len(clientData), clientData)
 		// Forward data to Persona
 		message := make([]byte, 0)
 		message = append(message, byte(Client))
 		message = append(message, clientData...)
 
-		r.PersonaWriteChannel <- message
+		r.toPersona(message)
 	}
 }
 
 func (r *Router) RoutePersona() {
 	for {
-		personaData := <-r.PersonaReadChannel
+		var personaData []byte
+		select {
+		case personaData = <-r.PersonaReadChannel:
+		case <-r.done:
+			return
+		}
 		golog.Debug("Router.Route - PersonaReadChannel")
 		if len(personaData) < 1 {
 			golog.Debug("error, personaData was empty")
@@ -90,7 +133,11 @@ func (r *Router) RoutePersona() {
 		switch subsystem {
 		case Client:
 			golog.Debugf("---> Persona -> Client: [%v bytes]:%x", len(data), data)
-			r.ClientWriteChannel <- data
+			select {
+			case r.ClientWriteChannel <- data:
+			case <-r.done:
+				return
+			}
 		case Udpproxy:
 			request := udpproxy.NewRequest(data)
 
@@ -99,7 +146,11 @@ func (r *Router) RoutePersona() {
 				continue
 			} else {
 				golog.Debugf("---> Persona -> Udpproxy: %v", request)
-				r.Udp.PersonaInput <- request
+				select {
+				case r.Udp.PersonaInput <- request:
+				case <-r.done:
+					return
+				}
 			}
 		case Tcpproxy:
 			request := tcpproxy.NewRequest(data)
@@ -108,7 +159,11 @@ func (r *Router) RoutePersona() {
 				continue
 			} else {
 				golog.Debugf("---> Persona -> Tcpproxy: %v", request)
-				r.Tcp.PersonaInput <- request
+				select {
+				case r.Tcp.PersonaInput <- request:
+				case <-r.done:
+					return
+				}
 			}
 		case Timer:
 			request := timer.NewRequest(data)
@@ -117,7 +172,11 @@ func (r *Router) RoutePersona() {
 				continue
 			} else {
 				golog.Debugf("---> Persona -> Timer: %v", request)
-				r.Timer.PersonaInput <- request
+				select {
+				case r.Timer.PersonaInput <- request:
+				case <-r.done:
+					return
+				}
 			}
 		default:
 			golog.Debugf("~ 💥 bad message type %v", subsystem)
@@ -127,7 +186,12 @@ func (r *Router) RoutePersona() {
 
 func (r *Router) RouteTcpproxy() {
 	for {
-		tcpProxyResponse := <-r.Tcp.PersonaOutput
+		var tcpProxyResponse *tcpproxy.Response
+		select {
+		case tcpProxyResponse = <-r.Tcp.PersonaOutput:
+		case <-r.done:
+			return
+		}
 
 		golog.Debugf("<-- RouteTcpproxy: Persona <- Tcpproxy: %v", tcpProxyResponse)
 
@@ -143,7 +207,7 @@ func (r *Router) RouteTcpproxy() {
 			message = append(message, byte(Tcpproxy))
 			message = append(message, messageData...)
 
-			r.PersonaWriteChannel <- message
+			r.toPersona(message)
 
 		case tcpproxy.ResponseClose:
 			messageData, dataError := tcpProxyResponse.Data()
@@ -156,7 +220,20 @@ func (r *Router) RouteTcpproxy() {
 			message = append(message, byte(Tcpproxy))
 			message = append(message, messageData...)
 
-			r.PersonaWriteChannel <- message
+			r.toPersona(message)
+
+		case tcpproxy.ResponseReset:
+			messageData, dataError := tcpProxyResponse.Data()
+			if dataError != nil {
+				golog.Debug(dataError.Error())
+				continue
+			}
+
+			message := make([]byte, 0)
+			message = append(message, byte(Tcpproxy))
+			message = append(message, messageData...)
+
+			r.toPersona(message)
 
 		case tcpproxy.ResponseError:
 			if tcpProxyResponse.Error != nil {
@@ -172,7 +249,7 @@ func (r *Router) RouteTcpproxy() {
 				message = append(message, byte(Tcpproxy))
 				message = append(message, messageData...)
 
-				r.PersonaWriteChannel <- message
+				r.toPersona(message)
 			}
 
 		case tcpproxy.ResponseConnectSuccess:
@@ -186,7 +263,7 @@ func (r *Router) RouteTcpproxy() {
 			message = append(message, byte(Tcpproxy))
 			message = append(message, messageData...)
 
-			r.PersonaWriteChannel <- message
+			r.toPersona(message)
 
 		case tcpproxy.ResponseConnectFailure:
 			messageData, dataError := tcpProxyResponse.Data()
@@ -199,14 +276,19 @@ func (r *Router) RouteTcpproxy() {
 			message = append(message, byte(Tcpproxy))
 			message = append(message, messageData...)
 
-			r.PersonaWriteChannel <- message
+			r.toPersona(message)
 		}
 	}
 }
 
 func (r *Router) RouteUdpproxy() {
 	for {
-		udpProxyResponse := <-r.Udp.PersonaOutput
+		var udpProxyResponse *udpproxy.Response
+		select {
+		case udpProxyResponse = <-r.Udp.PersonaOutput:
+		case <-r.done:
+			return
+		}
 
 		golog.Debugf("<-- RouteUdpproxy: Persona <- Udpproxy: %v", udpProxyResponse)
 
@@ -222,7 +304,46 @@ func (r *Router) RouteUdpproxy() {
 			message = append(message, byte(Udpproxy))
 			message = append(message, messageData...)
 
-			r.PersonaWriteChannel <- message
+			r.toPersona(message)
+
+		case udpproxy.ResponseDataFrom:
+			messageData, dataError := udpProxyResponse.Data()
+			if dataError != nil {
+				golog.Debug(dataError.Error())
+				continue
+			}
+
+			message := make([]byte, 0)
+			message = append(message, byte(Udpproxy))
+			message = append(message, messageData...)
+
+			r.toPersona(message)
+
+		case udpproxy.ResponseClose:
+			messageData, dataError := udpProxyResponse.Data()
+			if dataError != nil {
+				golog.Debug(dataError.Error())
+				continue
+			}
+
+			message := make([]byte, 0)
+			message = append(message, byte(Udpproxy))
+			message = append(message, messageData...)
+
+			r.toPersona(message)
+
+		case udpproxy.ResponseUnreachable:
+			messageData, dataError := udpProxyResponse.Data()
+			if dataError != nil {
+				golog.Debug(dataError.Error())
+				continue
+			}
+
+			message := make([]byte, 0)
+			message = append(message, byte(Udpproxy))
+			message = append(message, messageData...)
+
+			r.toPersona(message)
 
 		case udpproxy.ResponseError:
 			messageData, dataError := udpProxyResponse.Data()
@@ -238,7 +359,7 @@ func (r *Router) RouteUdpproxy() {
 				message = append(message, byte(Udpproxy))
 				message = append(message, messageData...)
 
-				r.PersonaWriteChannel <- message
+				r.toPersona(message)
 			}
 		}
 	}
@@ -246,7 +367,12 @@ func (r *Router) RouteUdpproxy() {
 
 func (r *Router) RouteTimerProxy() {
 	for {
-		timerProxyResponse := <-r.Timer.PersonaOutput
+		var timerProxyResponse *timer.Response
+		select {
+		case timerProxyResponse = <-r.Timer.PersonaOutput:
+		case <-r.done:
+			return
+		}
 
 		golog.Debugf("<-- RouteTimerProxy: Persona <- TimerProxy: %v", timerProxyResponse)
 
@@ -260,6 +386,6 @@ func (r *Router) RouteTimerProxy() {
 		message = append(message, byte(Timer))
 		message = append(message, messageData...)
 
-		r.PersonaWriteChannel <- message
+		r.toPersona(message)
 	}
 }
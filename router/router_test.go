@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRouterStop checks that Route returns once the router is stopped, even while Persona isn't taking messages, and
+// closes the channels to the client and Persona so that their pumps can finish.
+func TestRouterStop(t *testing.T) {
+	clientRead := make(chan []byte)
+	clientWrite := make(chan []byte)
+	personaRead := make(chan []byte)
+	personaWrite := make(chan []byte)
+
+	router, routerError := NewRouter(clientRead, clientWrite, personaRead, personaWrite)
+	if routerError != nil {
+		t.Fatal(routerError)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		router.Route()
+		close(finished)
+	}()
+
+	// Nothing reads from personaWrite, so the router is left waiting to send this on.
+	clientRead <- []byte("hello")
+
+	router.Stop()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Route did not return after Stop")
+	}
+
+	if _, open := <-clientWrite; open {
+		t.Error("expected the channel to the client to be closed")
+	}
+
+	if _, open := <-personaWrite; open {
+		t.Error("expected the channel to Persona to be closed")
+	}
+}
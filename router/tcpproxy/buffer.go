@@ -0,0 +1,23 @@
+package tcpproxy
+
+// MinReadSize and MaxReadSize bound the buffer that ReadFromServer reads into. The read size doubles each time a read
+// fills the buffer, and halves when reads use less than a quarter of it.
+var MinReadSize = 2048
+var MaxReadSize = 65536
+
+// nextReadSize adapts the read size to how much data the last read returned.
+func nextReadSize(readSize int, bytesRead int) int {
+	if bytesRead == readSize && readSize < MaxReadSize {
+		readSize = readSize * 2
+		if readSize > MaxReadSize {
+			readSize = MaxReadSize
+		}
+	} else if bytesRead < readSize/4 && readSize > MinReadSize {
+		readSize = readSize / 2
+		if readSize < MinReadSize {
+			readSize = MinReadSize
+		}
+	}
+
+	return readSize
+}
@@ -0,0 +1,103 @@
+package tcpproxy
+
+import (
+	"context"
+	"net"
+	"router/ip"
+	"sync/atomic"
+	"time"
+)
+
+// Connection is the proxy's record of one upstream TCP connection.
+// Connections are only ever read or modified by the goroutine running Proxy.Run.
+type Connection struct {
+	lastUsed int64 // Unix nanoseconds, accessed atomically, see touch and LastUsed
+	queued   int64 // bytes waiting in Writes, accessed atomically, see queue and Proxy.unqueue
+
+	Identity *ip.Identity
+	Conn     net.Conn // nil until the dial has completed
+
+	// Hostname is the host:port to dial for a RequestOpenHostname request, otherwise it is empty and Identity.Destination is dialed.
+	Hostname string
+
+	// DialContext is cancelled when the connection is removed, which stops a dial that is still in progress.
+	DialContext context.Context
+	CancelDial  context.CancelFunc
+
+	// Writes is the bounded queue of data waiting to be written to the server by WriteToServer.
+	// It is closed by Proxy.Run when the connection is removed, which tells WriteToServer to finish up and close Conn.
+	// A nil entry tells WriteToServer to shut down the sending side of Conn once everything before it has been written.
+	Writes chan []byte
+
+	// FastOpen is set for connections opened with data, which are the only ones dialed with TCP_FASTOPEN_CONNECT.
+	FastOpen bool
+
+	// Flow is used by Persona to pause and resume reading from the server.
+	Flow *FlowControl
+
+	// WriteClosed is set when Persona has asked for the sending side of the connection to be shut down.
+	WriteClosed bool
+
+	// ReadClosed is set when the server has closed its side of the connection. Persona can still write until it closes the connection.
+	ReadClosed bool
+
+	// Closed is set when Persona closes a connection that is still dialing, so that the connection is closed as soon as the dial completes.
+	Closed bool
+}
+
+func NewConnection(identity *ip.Identity, now time.Time) *Connection {
+	writes := make(chan []byte, WriteQueueLength)
+	flow := NewFlowControl()
+	dialContext, cancelDial := context.WithCancel(context.Background())
+
+	connection := &Connection{Identity: identity, DialContext: dialContext, CancelDial: cancelDial, Writes: writes, Flow: flow}
+	connection.touch(now)
+
+	return connection
+}
+
+// queue adds data to Writes. It returns false if the queue already holds WriteQueueLength entries, or if data would
+// take it over WriteQueueBytes. An empty queue always takes data, however large.
+func (c *Connection) queue(data []byte) bool {
+	queued := atomic.AddInt64(&c.queued, int64(len(data)))
+	if queued > int64(len(data)) && queued > int64(WriteQueueBytes) {
+		atomic.AddInt64(&c.queued, -int64(len(data)))
+		return false
+	}
+
+	select {
+	case c.Writes <- data:
+		return true
+	default:
+		atomic.AddInt64(&c.queued, -int64(len(data)))
+		return false
+	}
+}
+
+// Destination is the address to dial for this connection.
+func (c *Connection) Destination() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+
+	return c.Identity.Destination
+}
+
+// connectResult is sent from a Connect goroutine back to Proxy.Run when a dial has completed.
+type connectResult struct {
+	connection *Connection
+	conn       net.Conn
+	dialError  error
+}
+
+// readResult is sent from a ReadFromServer goroutine back to Proxy.Run when the server will not send any more data.
+type readResult struct {
+	connection *Connection
+	readError  error // io.EOF if the server closed the connection gracefully
+}
+
+// writeResult is sent from a WriteToServer goroutine back to Proxy.Run when writing to the server has failed.
+type writeResult struct {
+	connection *Connection
+	writeError error
+}
@@ -0,0 +1,79 @@
+package tcpproxy
+
+import (
+	"router/ip"
+	"testing"
+	"time"
+)
+
+func TestWriteQueueBytes(t *testing.T) {
+	identity, identityError := ip.NewIdentityFromString("10.0.0.1:1000:192.0.2.1:80")
+	if identityError != nil {
+		t.Fatal(identityError)
+	}
+
+	connection := NewConnection(identity, time.Now())
+
+	// An empty queue takes a write of any size.
+	if !connection.queue(make([]byte, WriteQueueBytes+1)) {
+		t.Fatal("expected an empty queue to take a large write")
+	}
+
+	if connection.queue([]byte("more")) {
+		t.Fatal("expected a full queue to refuse another write")
+	}
+
+	<-connection.Writes
+	connection.queued = 0
+
+	for index := 0; index < WriteQueueLength; index++ {
+		if !connection.queue([]byte("x")) {
+			t.Fatalf("expected the queue to take write %d of %d", index+1, WriteQueueLength)
+		}
+	}
+
+	if connection.queue([]byte("x")) {
+		t.Fatal("expected the queue to refuse a write beyond WriteQueueLength")
+	}
+}
+
+func TestSessionQueueBytes(t *testing.T) {
+	saved := SessionQueueBytes
+	SessionQueueBytes = 1000
+	defer func() {
+		SessionQueueBytes = saved
+	}()
+
+	first, firstError := ip.NewIdentityFromString("10.0.0.1:1000:192.0.2.1:80")
+	second, secondError := ip.NewIdentityFromString("10.0.0.1:1001:192.0.2.1:80")
+	if firstError != nil || secondError != nil {
+		t.Fatal(firstError, secondError)
+	}
+
+	proxy := New()
+	a := NewConnection(first, time.Now())
+	b := NewConnection(second, time.Now())
+
+	// The session limit applies even to the first entry in an empty queue.
+	if proxy.queue(a, make([]byte, SessionQueueBytes+1)) {
+		t.Fatal("expected the session to refuse a write larger than SessionQueueBytes")
+	}
+
+	data := make([]byte, 600)
+	if !proxy.queue(a, data) {
+		t.Fatal("expected the session to take the first write")
+	}
+
+	if proxy.queue(b, data) {
+		t.Fatal("expected the session to refuse a write to another connection that would take it over SessionQueueBytes")
+	}
+
+	if !proxy.queue(b, data[:400]) {
+		t.Fatal("expected the session to take a write that fits")
+	}
+
+	proxy.unqueue(a, <-a.Writes)
+	if !proxy.queue(b, data) {
+		t.Fatal("expected the session to take a write once the first was written")
+	}
+}
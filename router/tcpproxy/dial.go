@@ -0,0 +1,229 @@
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/kataras/golog"
+	"net"
+	"router/clock"
+	"syscall"
+	"time"
+)
+
+// DialTimeout limits each dial attempt. Failed attempts are retried up to DialAttempts times, DialRetryDelay apart,
+// unless the server refused the connection or policy denied it.
+var DialTimeout = 10 * time.Second
+var DialAttempts = 1
+var DialRetryDelay = 1 * time.Second
+
+// FallbackDelay is the delay before dialing the next address of a host with several, as in RFC 8305 (Happy Eyeballs).
+// A negative FallbackDelay disables parallel dialing.
+var FallbackDelay = 300 * time.Millisecond
+
+// newDialer returns a dialer that checks policy and sets socket options on each socket before it connects. fastOpen
+// allows TCP_FASTOPEN_CONNECT, which is only safe when the client has sent data for the SYN to carry.
+func newDialer(fastOpen bool) *net.Dialer {
+	control := func(network string, address string, rawConn syscall.RawConn) error {
+		policyError := checkPolicy(network, address, rawConn)
+		if policyError != nil {
+			return policyError
+		}
+
+		return setSocketOptions(network, address, rawConn, fastOpen)
+	}
+
+	return &net.Dialer{Timeout: DialTimeout, KeepAlive: KeepAlive, Control: control}
+}
+
+// dial connects to address, retrying according to the dial configuration. It gives up early if ctx is cancelled.
+func dial(ctx context.Context, clock clock.Clock, address string, fastOpen bool) (net.Conn, error) {
+	dialer := newDialer(fastOpen)
+
+	attempts := DialAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var dialError error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			golog.Debugf("retrying dial to %s (attempt %d of %d) - %v", address, attempt, attempts, dialError)
+
+			select {
+			case <-clock.After(DialRetryDelay):
+			case <-ctx.Done():
+				return nil, dialError
+			}
+		}
+
+		var conn net.Conn
+		conn, dialError = dialOnce(ctx, clock, dialer, address)
+		if dialError == nil {
+			optionError := setConnectionOptions(conn)
+			if optionError != nil {
+				golog.Debugf("error setting socket options for %s - %v", address, optionError)
+			}
+
+			return conn, nil
+		}
+
+		if errors.Is(dialError, syscall.ECONNREFUSED) || errors.Is(dialError, errPolicyDenied) || ctx.Err() != nil {
+			return nil, dialError
+		}
+	}
+
+	return nil, dialError
+}
+
+// dialOnce makes a single attempt to connect to address. If the host is a name rather than an IP address, it is
+// resolved through the cache and the resulting addresses are dialed with dialParallel.
+func dialOnce(ctx context.Context, clock clock.Clock, dialer *net.Dialer, address string) (net.Conn, error) {
+	host, port, splitError := net.SplitHostPort(address)
+	if splitError != nil {
+		return nil, splitError
+	}
+
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	dialContext, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+
+	hostIPs, resolveError := resolve(dialContext, clock, host)
+	if resolveError != nil {
+		return nil, resolveError
+	}
+
+	addresses := make([]string, 0, len(hostIPs))
+	for _, hostIP := range interleaveFamilies(hostIPs) {
+		addresses = append(addresses, net.JoinHostPort(hostIP.String(), port))
+	}
+
+	return dialParallel(dialContext, clock, dialer, addresses)
+}
+
+// interleaveFamilies orders ips so that IPv6 and IPv4 addresses alternate, starting with the family of the first one,
+// so that a broken family only delays the dial by FallbackDelay (RFC 8305 section 4).
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+
+	first := ips[0].To4() != nil
+	preferred := make([]net.IP, 0, len(ips))
+	other := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == first {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+
+	interleaved := make([]net.IP, 0, len(ips))
+	for index := 0; index < len(preferred) || index < len(other); index++ {
+		if index < len(preferred) {
+			interleaved = append(interleaved, preferred[index])
+		}
+		if index < len(other) {
+			interleaved = append(interleaved, other[index])
+		}
+	}
+
+	return interleaved
+}
+
+// dialParallel starts dialing each address FallbackDelay after the previous one, and returns the first connection to succeed.
+// If FallbackDelay is negative the addresses are tried one at a time.
+func dialParallel(ctx context.Context, clock clock.Clock, dialer *net.Dialer, addresses []string) (net.Conn, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("error, hostname did not resolve to any addresses")
+	}
+
+	if FallbackDelay < 0 || len(addresses) == 1 {
+		var dialError error
+		for _, address := range addresses {
+			var conn net.Conn
+			conn, dialError = dialer.DialContext(ctx, "tcp", address)
+			if dialError == nil || ctx.Err() != nil {
+				return conn, dialError
+			}
+		}
+		return nil, dialError
+	}
+
+	type dialResult struct {
+		conn      net.Conn
+		dialError error
+	}
+
+	raceContext, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addresses))
+	for index, address := range addresses {
+		go func(delay time.Duration, address string) {
+			select {
+			case <-clock.After(delay):
+			case <-raceContext.Done():
+				results <- dialResult{nil, raceContext.Err()}
+				return
+			}
+
+			conn, dialError := dialer.DialContext(raceContext, "tcp", address)
+			results <- dialResult{conn, dialError}
+		}(time.Duration(index)*FallbackDelay, address)
+	}
+
+	var firstError error
+	for index := range addresses {
+		result := <-results
+		if result.dialError == nil {
+			// Close any connections that also succeed after this one.
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					late := <-results
+					if late.conn != nil {
+						_ = late.conn.Close()
+					}
+				}
+			}(len(addresses) - index - 1)
+
+			return result.conn, nil
+		}
+
+		if firstError == nil {
+			firstError = result.dialError
+		}
+	}
+
+	return nil, firstError
+}
+
+// connectFailureReason works out why a dial failed, so that Persona can tell the client.
+func connectFailureReason(dialError error) ConnectFailureReason {
+	if errors.Is(dialError, errPolicyDenied) {
+		return ConnectFailurePolicyDenied
+	}
+
+	if errors.Is(dialError, syscall.ECONNREFUSED) {
+		return ConnectFailureRefused
+	}
+
+	var dnsError *net.DNSError
+	if errors.Is(dialError, syscall.EHOSTUNREACH) || errors.Is(dialError, syscall.EHOSTDOWN) || errors.As(dialError, &dnsError) {
+		return ConnectFailureHostUnreachable
+	}
+
+	if errors.Is(dialError, syscall.ENETUNREACH) || errors.Is(dialError, syscall.ENETDOWN) {
+		return ConnectFailureNetworkUnreachable
+	}
+
+	var netError net.Error
+	if errors.Is(dialError, syscall.ETIMEDOUT) || (errors.As(dialError, &netError) && netError.Timeout()) {
+		return ConnectFailureTimeout
+	}
+
+	return ConnectFailureUnknown
+}
@@ -0,0 +1,93 @@
+package tcpproxy
+
+import (
+	"context"
+	"net"
+	"router/clock"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+	}
+
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+
+	interleaved := interleaveFamilies(ips)
+	if len(interleaved) != len(expected) {
+		t.Fatalf("expected %d addresses, got %d", len(expected), len(interleaved))
+	}
+
+	for index, ip := range interleaved {
+		if ip.String() != expected[index] {
+			t.Errorf("address %d: expected %s, got %s", index, expected[index], ip.String())
+		}
+	}
+}
+
+// TestDialRetry checks that a failed dial is retried once DialRetryDelay has passed. The first attempt fails because
+// the resolver cache says that localhost has no addresses.
+func TestDialRetry(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	_, port, splitError := net.SplitHostPort(address)
+	if splitError != nil {
+		t.Fatal(splitError)
+	}
+
+	fake := clock.NewFake(time.Unix(1000, 0))
+
+	saved := DialAttempts
+	DialAttempts = 2
+	defer func() {
+		DialAttempts = saved
+	}()
+
+	resolveCacheLock.Lock()
+	resolveCache["localhost"] = resolvedHost{[]net.IP{}, fake.Now().Add(time.Hour)}
+	resolveCacheLock.Unlock()
+	defer func() {
+		resolveCacheLock.Lock()
+		delete(resolveCache, "localhost")
+		resolveCacheLock.Unlock()
+	}()
+
+	type dialResult struct {
+		conn      net.Conn
+		dialError error
+	}
+
+	results := make(chan dialResult, 1)
+	go func() {
+		conn, dialError := dial(context.Background(), fake, net.JoinHostPort("localhost", port), false)
+		results <- dialResult{conn, dialError}
+	}()
+
+	// Wait for the first attempt to fail and the retry delay to start. By the time of the retry, localhost resolves to
+	// just the address that the server is listening on, so that the retry doesn't wait for FallbackDelay.
+	fake.BlockUntil(1)
+
+	resolveCacheLock.Lock()
+	resolveCache["localhost"] = resolvedHost{[]net.IP{net.IPv4(127, 0, 0, 1)}, fake.Now().Add(time.Hour)}
+	resolveCacheLock.Unlock()
+
+	fake.Advance(DialRetryDelay)
+
+	select {
+	case result := <-results:
+		if result.dialError != nil {
+			t.Fatalf("expected the retry to succeed, got %v", result.dialError)
+		}
+		_ = result.conn.Close()
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the retry to connect")
+	}
+}
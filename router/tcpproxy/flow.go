@@ -0,0 +1,74 @@
+package tcpproxy
+
+import "sync"
+
+// FlowControl lets Persona pause reading from a server while the client catches up, so that TCP flow control slows the
+// server down instead of the data piling up in Persona.
+type FlowControl struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	paused  bool
+	closed  bool
+}
+
+func NewFlowControl() *FlowControl {
+	flow := &FlowControl{}
+	flow.changed = sync.NewCond(&flow.lock)
+
+	return flow
+}
+
+func (f *FlowControl) Pause() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.paused = true
+}
+
+func (f *FlowControl) Resume() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.paused = false
+	f.changed.Broadcast()
+}
+
+// Close releases any goroutine waiting in Wait. Once closed, Wait always returns false.
+func (f *FlowControl) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.closed = true
+	f.changed.Broadcast()
+}
+
+// Wait blocks while the connection is paused. It returns false if flow control was closed while waiting.
+func (f *FlowControl) Wait() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for f.paused && !f.closed {
+		f.changed.Wait()
+	}
+
+	return !f.closed
+}
+
+// Deliver sends response on output unless flow control has been closed, and returns false if it has. Close waits for
+// a delivery in progress, so nothing is delivered for a connection once it has been removed. Deliver gives up and
+// returns false if done is closed while it is waiting for output.
+func (f *FlowControl) Deliver(output chan *Response, response *Response, done chan struct{}) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return false
+	}
+
+	select {
+	case output <- response:
+		return true
+	case <-done:
+		return false
+	}
+}
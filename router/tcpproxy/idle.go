@@ -0,0 +1,66 @@
+package tcpproxy
+
+import (
+	"github.com/kataras/golog"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimeout closes connections that carry no data for that long. MaxConnections limits the connections per session,
+// closing the least recently used one to make room. Either limit is disabled by setting it to 0.
+var IdleTimeout = 1 * time.Hour
+var IdleCheckInterval = 1 * time.Minute
+var MaxConnections = 4096
+
+// touch records that the connection was used at now. It is called from both Proxy.Run and ReadFromServer.
+func (c *Connection) touch(now time.Time) {
+	atomic.StoreInt64(&c.lastUsed, now.UnixNano())
+}
+
+func (c *Connection) LastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastUsed))
+}
+
+// closeIdle closes every connection that has been idle for longer than IdleTimeout.
+func (p *Proxy) closeIdle() {
+	if IdleTimeout <= 0 {
+		return
+	}
+
+	now := p.Clock.Now()
+	for _, connection := range p.Connections {
+		if now.Sub(connection.LastUsed()) > IdleTimeout {
+			golog.Debugf("tcpproxy.Proxy.Run - closing idle connection %s", connection.Identity.String())
+			p.evict(connection)
+		}
+	}
+}
+
+// makeRoom closes the least recently used connection if the session is at its connection limit.
+func (p *Proxy) makeRoom() {
+	if MaxConnections <= 0 || len(p.Connections) < MaxConnections {
+		return
+	}
+
+	var leastRecentlyUsed *Connection
+	for _, connection := range p.Connections {
+		if leastRecentlyUsed == nil || connection.LastUsed().Before(leastRecentlyUsed.LastUsed()) {
+			leastRecentlyUsed = connection
+		}
+	}
+
+	if leastRecentlyUsed != nil {
+		golog.Debugf("tcpproxy.Proxy.Run - too many connections, closing %s", leastRecentlyUsed.Identity.String())
+		p.evict(leastRecentlyUsed)
+	}
+}
+
+// evict closes a connection that Persona still thinks is open, and tells Persona that it was reset.
+func (p *Proxy) evict(connection *Connection) {
+	if connection.Conn == nil {
+		connection.Closed = true
+	}
+
+	p.remove(connection)
+	p.respond(NewResetResponse(connection.Identity))
+}
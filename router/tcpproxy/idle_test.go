@@ -0,0 +1,165 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"router/clock"
+	"testing"
+	"time"
+)
+
+// nextResponse waits for the next response from a proxy whose output isn't being routed by a responseRouter. It
+// returns nil if there isn't one within a reasonable time.
+func nextResponse(t testing.TB, proxy *Proxy) *Response {
+	select {
+	case response := <-proxy.PersonaOutput:
+		return response
+	case <-time.After(10 * time.Second):
+		t.Error("timed out waiting for a response")
+		return nil
+	}
+}
+
+// TestCloseIdle checks that a connection is reset once it has carried no data for IdleTimeout, and that data in
+// either direction postpones that.
+func TestCloseIdle(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	// The output is buffered, so that once sync has returned every response that Run has sent is waiting there.
+	fake := clock.NewFake(time.Unix(1000, 0))
+	proxy := New()
+	proxy.Clock = fake
+	proxy.PersonaOutput = make(chan *Response, 1024)
+	go proxy.Run()
+
+	identity := newTestIdentity(t, "10.0.0.1:1000", address)
+	proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+	response := nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseConnectSuccess {
+		t.Fatalf("expected connect success, got %v", response)
+	}
+
+	start := fake.Now()
+	wrote := false
+	for {
+		if fake.Now().Sub(start) > 2*IdleTimeout {
+			t.Fatal("the idle connection was never closed")
+		}
+
+		// Halfway through, an echo keeps the connection busy.
+		if !wrote && fake.Now().Sub(start) >= IdleTimeout/2 {
+			wrote = true
+			proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+			response = nextResponse(t, proxy)
+			if response == nil || response.Type != ResponseData {
+				t.Fatalf("expected data, got %v", response)
+			}
+		}
+
+		fake.Advance(IdleCheckInterval)
+		proxy.sync()
+
+		if len(proxy.PersonaOutput) == 0 {
+			continue
+		}
+
+		response = <-proxy.PersonaOutput
+		if response.Type != ResponseReset {
+			t.Fatalf("expected a reset response, got %v", response.Type)
+		}
+
+		elapsed := fake.Now().Sub(start)
+		if elapsed <= IdleTimeout*3/2 || elapsed > IdleTimeout*3/2+2*IdleCheckInterval {
+			t.Errorf("expected the connection to be closed %v after it was last used, it was closed after %v", IdleTimeout, elapsed)
+		}
+		return
+	}
+}
+
+// TestMaxConnections checks that opening one connection too many resets the least recently used one.
+func TestMaxConnections(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	saved := MaxConnections
+	MaxConnections = 2
+	defer func() {
+		MaxConnections = saved
+	}()
+
+	fake := clock.NewFake(time.Unix(1000, 0))
+	proxy := New()
+	proxy.Clock = fake
+	go proxy.Run()
+	responses := newResponseRouter(proxy.PersonaOutput)
+
+	for index := 0; index < 3; index++ {
+		identity := newTestIdentity(t, fmt.Sprintf("10.0.0.1:%d", 1000+index), address)
+
+		proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+		response := responses.next(t, identity)
+		if response == nil || response.Type != ResponseConnectSuccess {
+			t.Fatalf("expected connect success, got %v", response)
+		}
+
+		fake.Advance(time.Second)
+	}
+
+	first := newTestIdentity(t, "10.0.0.1:1000", address)
+	response := responses.next(t, first)
+	if response == nil || response.Type != ResponseReset {
+		t.Fatalf("expected the least recently used connection to be reset, got %v", response)
+	}
+}
+
+// TestEvictStalled checks that evicting a connection whose server has stopped reading really closes its socket, even
+// though its writer is stuck.
+func TestEvictStalled(t *testing.T) {
+	stalledAddress, accepted, stopStalled := startSilentServer(t)
+	defer stopStalled()
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	savedConnections, savedLength, savedBytes := MaxConnections, WriteQueueLength, WriteQueueBytes
+	MaxConnections = 1
+	WriteQueueLength = 1024
+	WriteQueueBytes = 64 * 1024 * 1024
+	defer func() {
+		MaxConnections, WriteQueueLength, WriteQueueBytes = savedConnections, savedLength, savedBytes
+	}()
+
+	proxy := New()
+	go proxy.Run()
+	responses := newResponseRouter(proxy.PersonaOutput)
+
+	stalled := newTestIdentity(t, "10.0.0.1:1000", stalledAddress)
+	proxy.PersonaInput <- &Request{RequestOpen, stalled, nil}
+	response := responses.next(t, stalled)
+	if response == nil || response.Type != ResponseConnectSuccess {
+		t.Fatalf("expected connect success, got %v", response)
+	}
+
+	server := <-accepted
+	defer server.Close()
+
+	// Queue far more than the kernel will buffer, so that the writer is stuck waiting for the server.
+	data := make([]byte, 65536)
+	queued := 512 * len(data)
+	for index := 0; index < 512; index++ {
+		proxy.PersonaInput <- &Request{RequestWrite, stalled, data}
+	}
+
+	other := newTestIdentity(t, "10.0.0.1:1001", address)
+	proxy.PersonaInput <- &Request{RequestOpen, other, nil}
+	response = responses.next(t, stalled)
+	if response == nil || response.Type != ResponseReset {
+		t.Fatalf("expected the stalled connection to be reset, got %v", response)
+	}
+
+	response = responses.next(t, other)
+	if response == nil || response.Type != ResponseConnectSuccess {
+		t.Fatalf("expected connect success, got %v", response)
+	}
+
+	expectClosed(t, server, queued)
+}
@@ -0,0 +1,55 @@
+package tcpproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// DeniedNetworks lists the networks that Persona's clients are not allowed to connect to through the router.
+var DeniedNetworks []*net.IPNet
+
+var errPolicyDenied = errors.New("error, destination is denied by policy")
+
+// SetDeniedNetworks parses a comma separated list of CIDR networks into DeniedNetworks.
+func SetDeniedNetworks(cidrs string) error {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, network, parseError := net.ParseCIDR(cidr)
+		if parseError != nil {
+			return parseError
+		}
+
+		networks = append(networks, network)
+	}
+
+	DeniedNetworks = networks
+	return nil
+}
+
+// checkPolicy is called from the dialer's Control hook, so that it sees the actual address being dialed after any name resolution.
+func checkPolicy(_ string, address string, _ syscall.RawConn) error {
+	host, _, splitError := net.SplitHostPort(address)
+	if splitError != nil {
+		return splitError
+	}
+
+	hostIP := net.ParseIP(host)
+	if hostIP == nil {
+		return errPolicyDenied
+	}
+
+	for _, denied := range DeniedNetworks {
+		if denied.Contains(hostIP) {
+			return errPolicyDenied
+		}
+	}
+
+	return nil
+}
@@ -3,137 +3,550 @@ package tcpproxy
 import (
 	"errors"
 	"github.com/kataras/golog"
+	"io"
 	"net"
+	"router/clock"
 	"router/ip"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+/*
+The Connections map is owned by the goroutine running Run. Other goroutines never touch it directly.
+Connect goroutines report the result of a dial on the connected channel and ReadFromServer goroutines report that
+their server has stopped sending on the disconnected channel. Run applies these changes to the map itself.
+
+When a server closes its side of a connection gracefully, Persona is sent a close response so that it can send a FIN
+to the client. The connection stays open for writing until Persona closes it. When a server resets the connection, or
+reading fails for any other reason, the connection is removed and Persona is sent a reset response so that it can send
+an RST to the client.
+
+Run never writes to a server itself. Each connection has its own WriteToServer goroutine fed by a bounded queue, so a
+server that is slow to read only holds up its own connection. If a connection's queue fills up, the connection is
+closed rather than dropping data from the middle of the stream. If writing to the server fails, WriteToServer reports
+it on the writeFailed channel, and Run removes the connection and sends Persona a reset response.
+
+Removing a connection closes its socket straight away, which stops both of its goroutines even if the server has
+stopped reading. The exception is when Persona closes the connection itself, in which case whatever is still queued
+is written first, as long as the server accepts it within CloseTimeout.
+
+Persona can half-close a connection when the client has sent a FIN but still wants to receive data. The half-close is
+queued behind any pending writes and the server continues to be read until it closes its own side.
+
+Stop ends the session. Run removes every connection, closing its socket, and returns. Every goroutine that reports
+back to Run or sends to Persona gives up once the proxy has been stopped, so none of them are left blocked.
+*/
+
+// WriteQueueLength and WriteQueueBytes limit the pending writes that can be queued for a single connection, and
+// SessionQueueBytes limits the pending writes for all of a session's connections together.
+var WriteQueueLength = 256
+var WriteQueueBytes = 1024 * 1024        // 1 MiB
+var SessionQueueBytes = 64 * 1024 * 1024 // 64 MiB
+
+// CloseTimeout limits how long a connection closed by Persona can spend writing out its queue.
+var CloseTimeout = 10 * time.Second
+
 type Proxy struct {
-	Connections   map[string]net.Conn
+	queued int64 // bytes waiting in every connection's write queue, accessed atomically, see queue and unqueue
+
+	Connections   map[string]*Connection
 	PersonaInput  chan *Request
 	PersonaOutput chan *Response
+
+	// Clock is used for idle timeouts, dial retries and the resolver cache. It can be replaced before Run is called.
+	Clock clock.Clock
+
+	connected    chan *connectResult
+	disconnected chan *readResult
+	writeFailed  chan *writeResult
+	syncRequests chan chan struct{}
+
+	done    chan struct{} // closed by Stop
+	stopped sync.Once
 }
 
 func New() *Proxy {
-	connections := make(map[string]net.Conn)
+	connections := make(map[string]*Connection)
 	input := make(chan *Request)
 	output := make(chan *Response)
+	connected := make(chan *connectResult)
+	disconnected := make(chan *readResult)
+	writeFailed := make(chan *writeResult)
+	syncRequests := make(chan chan struct{})
+	done := make(chan struct{})
 
-	return &Proxy{connections, input, output}
+	return &Proxy{0, connections, input, output, clock.Real, connected, disconnected, writeFailed, syncRequests, done, sync.Once{}}
 }
 
 func (p *Proxy) Run() {
 	golog.Debug("tcpproxy.Proxy.Run()")
+
+	idleCheck := p.Clock.NewTicker(IdleCheckInterval)
+	defer idleCheck.Stop()
+
 	for {
 		golog.Debug("tcpproxy.Proxy.Run - main loop, waiting for message on channel input")
-		request := <-p.PersonaInput
-		golog.Debug("tcpproxy.Proxy.Run - PersonaInput")
-		switch request.Type {
-		case RequestOpen:
-			golog.Debug("tcpproxy.Proxy.Run - RequestOpen")
-			_, ok := p.Connections[request.Identity.String()]
-			if ok {
-				p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to open a connection that we already have open"))
-				continue
-			} else {
-				golog.Debugf("tcpproxy.Proxy.Run - connecting to upstream server %s\n", request.Identity.Destination)
-				go p.Connect(request.Identity)
+		select {
+		case request := <-p.PersonaInput:
+			golog.Debug("tcpproxy.Proxy.Run - PersonaInput")
+			p.handleRequest(request)
+		case result := <-p.connected:
+			golog.Debug("tcpproxy.Proxy.Run - connected")
+			p.handleConnected(result)
+		case result := <-p.disconnected:
+			golog.Debug("tcpproxy.Proxy.Run - disconnected")
+			p.handleDisconnected(result)
+		case result := <-p.writeFailed:
+			golog.Debug("tcpproxy.Proxy.Run - write failed")
+			p.handleWriteFailed(result)
+		case <-idleCheck.C():
+			golog.Debug("tcpproxy.Proxy.Run - idle check")
+			p.closeIdle()
+		case done := <-p.syncRequests:
+			// A tick that is already waiting is handled first, so that it is finished with too.
+			select {
+			case <-idleCheck.C():
+				p.closeIdle()
+			default:
 			}
+			close(done)
+		case <-p.done:
+			golog.Debug("tcpproxy.Proxy.Run - stopped")
+			p.removeAll()
+			return
+		}
+	}
+}
 
-		case RequestWrite:
-			golog.Debug("tcpproxy.Proxy.Run - RequestWrite")
-			if request.Data == nil || len(request.Data) == 0 {
-				p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, bad write request, no data to write"))
-				continue
-			}
+// Stop closes every connection and stops Run. Nothing more is sent to PersonaOutput once Stop has been called.
+func (p *Proxy) Stop() {
+	p.stopped.Do(func() {
+		close(p.done)
+	})
+}
 
-			connection, ok := p.Connections[request.Identity.String()]
-			if ok {
-				bytesWrote, writeError := connection.Write(request.Data)
-				if writeError != nil {
-					p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, bad write"))
-					continue
-				}
-				if bytesWrote != len(request.Data) {
-					p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, short write"))
-					continue
-				}
-			} else {
-				p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to close a connection that we do not have"))
-				continue
+// removeAll removes every connection when the proxy is stopped. Connections that are still dialing are closed as soon
+// as the dial completes.
+func (p *Proxy) removeAll() {
+	for _, connection := range p.Connections {
+		if connection.Conn == nil {
+			connection.Closed = true
+		}
+		p.remove(connection)
+	}
+}
+
+// respond sends a response to Persona, unless the proxy has been stopped.
+func (p *Proxy) respond(response *Response) {
+	select {
+	case p.PersonaOutput <- response:
+	case <-p.done:
+	}
+}
+
+// sync waits until Run has finished with every request and tick that has already been delivered to it. Tests use it
+// after advancing a fake clock, instead of waiting for an arbitrary time.
+func (p *Proxy) sync() {
+	done := make(chan struct{})
+	p.syncRequests <- done
+	<-done
+}
+
+func (p *Proxy) handleRequest(request *Request) {
+	switch request.Type {
+	case RequestOpen, RequestOpenWithData, RequestOpenHostname:
+		golog.Debug("tcpproxy.Proxy.Run - RequestOpen")
+		_, ok := p.Connections[request.Identity.String()]
+		if ok {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to open a connection that we already have open")))
+			return
+		}
+
+		p.makeRoom()
+
+		connection := NewConnection(request.Identity, p.Clock.Now())
+		p.Connections[request.Identity.String()] = connection
+
+		if request.Type == RequestOpenHostname {
+			// NewRequest has already checked that the hostname is valid.
+			connection.Hostname, _ = HostnameDestination(request.Data)
+		} else if len(request.Data) > 0 {
+			// The initial data waits in the write queue, so it is the first thing written once the connection is established.
+			// With TCP_FASTOPEN_CONNECT it goes out with the SYN.
+			connection.FastOpen = true
+			if !p.queue(connection, request.Data) {
+				golog.Debugf("tcpproxy.Proxy.Run - write queues for the session are full, not opening %s", request.Identity.String())
+				connection.Closed = true
+				p.remove(connection)
+				p.respond(NewErrorResponse(request.Identity, errors.New("error, write queue is full")))
+				p.respond(NewConnectFailureResponse(request.Identity, ConnectFailureUnknown))
+				return
 			}
+		}
+
+		golog.Debugf("tcpproxy.Proxy.Run - connecting to upstream server %s\n", connection.Destination())
+
+		go p.Connect(connection)
+
+	case RequestWrite:
+		golog.Debug("tcpproxy.Proxy.Run - RequestWrite")
+		if request.Data == nil || len(request.Data) == 0 {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, bad write request, no data to write")))
+			return
+		}
 
-		case RequestClose:
-			golog.Debug("tcpproxy.Proxy.Run - RequestClose")
-			connection, ok := p.Connections[request.Identity.String()]
-			if ok {
-				_ = connection.Close()
-				delete(p.Connections, request.Identity.String())
-			} else {
-				golog.Debugf("error, Persona is requesting us to close a connection that we do not have: %s (%d open connections)", request.Identity.String(), len(p.Connections))
-
-				golog.Debug("tcpproxy.Proxy.Run - RequestClose - writing ResponseError")
-				p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to close a connection that we do not have"))
-				golog.Debug("tcpproxy.Proxy.Run - RequestClose - wrote ResponseError")
+		connection, ok := p.Connections[request.Identity.String()]
+		if !ok || connection.Conn == nil {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to write to a connection that we do not have")))
+			return
+		}
+
+		if connection.WriteClosed {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to write to a connection that it has already half-closed")))
+			return
+		}
+
+		connection.touch(p.Clock.Now())
+
+		if !p.queue(connection, request.Data) {
+			golog.Debugf("tcpproxy.Proxy.Run - write queue for %s is full, closing", request.Identity.String())
+			p.remove(connection)
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, write queue is full")))
+			p.respond(NewResetResponse(request.Identity))
+		}
+
+	case RequestCloseWrite:
+		golog.Debug("tcpproxy.Proxy.Run - RequestCloseWrite")
+		connection, ok := p.Connections[request.Identity.String()]
+		if !ok || connection.Conn == nil {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to half-close a connection that we do not have")))
+			return
+		}
+
+		if connection.WriteClosed {
+			return
+		}
+		connection.WriteClosed = true
+
+		if !p.queue(connection, nil) {
+			golog.Debugf("tcpproxy.Proxy.Run - write queue for %s is full, closing", request.Identity.String())
+			p.remove(connection)
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, write queue is full")))
+			p.respond(NewResetResponse(request.Identity))
+		}
+
+	case RequestPause:
+		golog.Debug("tcpproxy.Proxy.Run - RequestPause")
+		connection, ok := p.Connections[request.Identity.String()]
+		if !ok {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to pause a connection that we do not have")))
+			return
+		}
+
+		connection.Flow.Pause()
+
+	case RequestResume:
+		golog.Debug("tcpproxy.Proxy.Run - RequestResume")
+		connection, ok := p.Connections[request.Identity.String()]
+		if !ok {
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to resume a connection that we do not have")))
+			return
+		}
+
+		connection.Flow.Resume()
+
+	case RequestClose:
+		golog.Debug("tcpproxy.Proxy.Run - RequestClose")
+		connection, ok := p.Connections[request.Identity.String()]
+		if ok {
+			if connection.Conn == nil {
+				connection.Closed = true
 			}
-		default:
-			golog.Debug("tcpproxy.Proxy.Run - RequestClose - writing ResponseError due to unknown type")
-			p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("unknown TCP proxy request type"))
-			golog.Debug("tcpproxy.Proxy.Run - RequestClose - wrote ResponseError due to unknown type")
-			continue
+			p.close(connection)
+		} else {
+			golog.Debugf("error, Persona is requesting us to close a connection that we do not have: %s (%d open connections)", request.Identity.String(), len(p.Connections))
+
+			golog.Debug("tcpproxy.Proxy.Run - RequestClose - writing ResponseError")
+			p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to close a connection that we do not have")))
+			golog.Debug("tcpproxy.Proxy.Run - RequestClose - wrote ResponseError")
 		}
+
+	default:
+		golog.Debug("tcpproxy.Proxy.Run - writing ResponseError due to unknown type")
+		p.respond(NewErrorResponse(request.Identity, errors.New("unknown TCP proxy request type")))
+		golog.Debug("tcpproxy.Proxy.Run - wrote ResponseError due to unknown type")
 	}
 }
 
-func (p *Proxy) Connect(identity *ip.Identity) {
-	golog.Debugf("dialing %s\n", identity.Destination)
-	conn, dialError := net.Dial("tcp", identity.Destination)
-	if dialError != nil {
-		golog.Debugf("error dialing %s - %v\n", identity.Destination, dialError)
-		p.PersonaOutput <- NewErrorResponse(identity, dialError)
-		p.PersonaOutput <- NewConnectFailureResponse(identity)
+func (p *Proxy) handleConnected(result *connectResult) {
+	connection := result.connection
+	identity := connection.Identity
+
+	if result.dialError != nil {
+		golog.Debugf("error dialing %s - %v\n", identity.Destination, result.dialError)
+		p.remove(connection)
+		p.release(connection)
+
+		if !connection.Closed {
+			p.respond(NewErrorResponse(identity, result.dialError))
+			p.respond(NewConnectFailureResponse(identity, connectFailureReason(result.dialError)))
+		}
 		return
 	}
 
-	p.Connections[identity.String()] = conn
+	if connection.Closed {
+		golog.Debugf("tcpproxy.Proxy.Run - connection to %s was closed while dialing", identity.Destination)
+		_ = result.conn.Close()
+		p.release(connection)
+		return
+	}
+
+	response := NewConnectSuccessResponse(identity)
+	if connection.Hostname != "" {
+		resolved, resolvedError := encodeRemoteAddr(result.conn)
+		if resolvedError != nil {
+			// Persona can't be told which address the hostname resolved to, so the connection is no use to it.
+			golog.Debugf("error encoding resolved address for %s - %v", connection.Hostname, resolvedError)
+			_ = result.conn.Close()
+			p.remove(connection)
+			p.release(connection)
+			p.respond(NewErrorResponse(identity, resolvedError))
+			p.respond(NewConnectFailureResponse(identity, ConnectFailureUnknown))
+			return
+		}
+
+		response = NewResolvedConnectSuccessResponse(identity, resolved)
+	}
+
+	connection.Conn = result.conn
 
-	go p.ReadFromServer(conn, identity, p.PersonaOutput)
+	go p.ReadFromServer(connection, p.PersonaOutput)
+	go p.WriteToServer(connection)
 
-	golog.Debugf(" dialing %s\n", identity.Destination)
-	golog.Debug("sending connect  response")
-	p.PersonaOutput <- NewConnectSuccessResponse(identity)
+	golog.Debug("sending connect response")
+	p.respond(response)
 }
 
-func (p *Proxy) ReadFromServer(server net.Conn, identity *ip.Identity, output chan *Response) {
+// encodeRemoteAddr encodes the address that conn is connected to as an address family byte followed by the host and port.
+func encodeRemoteAddr(conn net.Conn) ([]byte, error) {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("error, connection does not have a TCP remote address")
+	}
+
+	return ip.IPToTaggedAddressBytes(tcpAddr.IP, tcpAddr.Port)
+}
+
+func (p *Proxy) handleDisconnected(result *readResult) {
+	connection := result.connection
+	identity := connection.Identity
+
+	// If Persona has already closed the connection then there is no need to tell it about it.
+	if p.Connections[identity.String()] != connection {
+		return
+	}
+
+	if result.readError == io.EOF {
+		golog.Debugf("tcpproxy.Proxy.Run - %s closed the connection", identity.Destination)
+		connection.ReadClosed = true
+		p.respond(NewCloseResponse(identity))
+		return
+	}
+
+	p.remove(connection)
+
+	if !errors.Is(result.readError, syscall.ECONNRESET) {
+		p.respond(NewErrorResponse(identity, result.readError))
+	}
+
+	golog.Debugf("tcpproxy.Proxy.Run - %s reset the connection", identity.Destination)
+	p.respond(NewResetResponse(identity))
+}
+
+// handleWriteFailed resets a connection that could not be written to.
+func (p *Proxy) handleWriteFailed(result *writeResult) {
+	connection := result.connection
+	identity := connection.Identity
+
+	if p.Connections[identity.String()] != connection {
+		return
+	}
+
+	golog.Debugf("tcpproxy.Proxy.Run - error writing to %s - %v", identity.Destination, result.writeError)
+	p.remove(connection)
+
+	// Once the server has closed its side, a failed write only means that it has gone away completely.
+	if !connection.ReadClosed {
+		p.respond(NewErrorResponse(identity, result.writeError))
+	}
+	p.respond(NewResetResponse(identity))
+}
+
+// remove deletes a connection from the table and closes it, dropping anything still waiting to be written.
+func (p *Proxy) remove(connection *Connection) {
+	if !p.detach(connection) {
+		return
+	}
+
+	if connection.Conn != nil {
+		_ = connection.Conn.Close()
+	}
+}
+
+// close deletes a connection that Persona has closed from the table. WriteToServer writes out the rest of the queue and
+// then closes the connection, unless the server takes longer than CloseTimeout to accept it.
+func (p *Proxy) close(connection *Connection) {
+	if !p.detach(connection) {
+		return
+	}
+
+	if connection.Conn != nil {
+		// Socket deadlines are always in real time, so this doesn't use p.Clock.
+		_ = connection.Conn.SetWriteDeadline(time.Now().Add(CloseTimeout))
+	}
+}
+
+// detach deletes a connection from the table, stops it dialing, closes its write queue and stops its reader from
+// delivering any more data. Persona may have already closed this connection and opened a new one with the same
+// identity, in which case this does nothing and returns false.
+func (p *Proxy) detach(connection *Connection) bool {
+	if p.Connections[connection.Identity.String()] != connection {
+		return false
+	}
+
+	delete(p.Connections, connection.Identity.String())
+	connection.CancelDial()
+	close(connection.Writes)
+	connection.Flow.Close()
+
+	return true
+}
+
+func (p *Proxy) Connect(connection *Connection) {
+	golog.Debugf("dialing %s\n", connection.Destination())
+	conn, dialError := dial(connection.DialContext, p.Clock, connection.Destination(), connection.FastOpen)
+	select {
+	case p.connected <- &connectResult{connection, conn, dialError}:
+	case <-p.done:
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+// ReadFromServer reads from the server until it closes the connection or the connection is closed by Run or WriteToServer.
+func (p *Proxy) ReadFromServer(connection *Connection, output chan *Response) {
+	server := connection.Conn
+	identity := connection.Identity
+
+	// Each reader has its own buffer, because a pooled one would be held for the whole time that Read is blocked.
+	buffer := make([]byte, MinReadSize)
 	for {
-		setError := server.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) // 100 milliseconds
-		if setError != nil {
-			output <- NewErrorResponse(identity, setError)
-			delete(p.Connections, identity.String())
+		if !connection.Flow.Wait() {
+			// The connection has been removed, so there is nobody left to deliver data to.
 			return
 		}
 
-		readLength := 1024
-		buffer := make([]byte, readLength)
 		bytesRead, readError := server.Read(buffer)
 		if bytesRead > 0 {
-			if bytesRead < readLength {
-				buffer = buffer[:bytesRead]
-			}
+			connection.touch(p.Clock.Now())
+
+			data := make([]byte, bytesRead)
+			copy(data, buffer[:bytesRead])
 
-			output <- NewDataResponse(identity, buffer)
+			if !connection.Flow.Deliver(output, NewDataResponse(identity, data), p.done) {
+				return
+			}
 		}
+
 		if readError != nil {
-			// Ignore timeouts, timeouts are fine, they are what allow us to do short reads.
-			timeoutError, ok := readError.(*net.OpError)
-			if ok {
-				if timeoutError.Timeout() {
-					continue
-				}
+			select {
+			case p.disconnected <- &readResult{connection, readError}:
+			case <-p.done:
 			}
-
-			delete(p.Connections, identity.String())
 			return
 		}
+
+		readSize := nextReadSize(len(buffer), bytesRead)
+		if readSize != len(buffer) {
+			buffer = make([]byte, readSize)
+		}
 	}
 }
+
+// WriteToServer writes queued data to the server until the write queue is closed, then closes the connection.
+// If a write fails, it reports the failure to Run and discards the rest of the queue.
+func (p *Proxy) WriteToServer(connection *Connection) {
+	server := connection.Conn
+
+	defer func() {
+		_ = server.Close()
+	}()
+
+	failed := false
+	for data := range connection.Writes {
+		if failed {
+			p.unqueue(connection, data)
+			continue
+		}
+
+		var writeError error
+		if data == nil {
+			writeError = closeWrite(server)
+		} else {
+			// Write always returns an error if it could not write all of data.
+			_, writeError = server.Write(data)
+		}
+		p.unqueue(connection, data)
+
+		if writeError != nil {
+			select {
+			case p.writeFailed <- &writeResult{connection, writeError}:
+			case <-p.done:
+			}
+			failed = true
+		}
+	}
+}
+
+// queue adds data to a connection's write queue. It returns false if the connection or the session as a whole already
+// has too much queued.
+func (p *Proxy) queue(connection *Connection, data []byte) bool {
+	size := int64(len(data))
+	if atomic.AddInt64(&p.queued, size) > int64(SessionQueueBytes) {
+		atomic.AddInt64(&p.queued, -size)
+		return false
+	}
+
+	if !connection.queue(data) {
+		atomic.AddInt64(&p.queued, -size)
+		return false
+	}
+
+	return true
+}
+
+// unqueue accounts for data that has been taken off a connection's write queue.
+func (p *Proxy) unqueue(connection *Connection, data []byte) {
+	atomic.AddInt64(&connection.queued, -int64(len(data)))
+	atomic.AddInt64(&p.queued, -int64(len(data)))
+}
+
+// release empties the write queue of a removed connection that never got a WriteToServer goroutine.
+func (p *Proxy) release(connection *Connection) {
+	for data := range connection.Writes {
+		p.unqueue(connection, data)
+	}
+}
+
+// closeWrite shuts down the sending side of a connection, which sends a FIN to the server.
+func closeWrite(server net.Conn) error {
+	tcpConn, ok := server.(*net.TCPConn)
+	if !ok {
+		return errors.New("error, connection does not support half-close")
+	}
+
+	return tcpConn.CloseWrite()
+}
@@ -0,0 +1,375 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"router/ip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a TCP server that echoes everything back and closes its side once the client half-closes.
+func startEchoServer(t testing.TB) (string, func()) {
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+
+	go func() {
+		for {
+			conn, acceptError := listener.Accept()
+			if acceptError != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() { _ = listener.Close() }
+}
+
+// responseRouter hands each response from the proxy to the channel for its identity, like the router does for Persona.
+type responseRouter struct {
+	lock     sync.Mutex
+	channels map[string]chan *Response
+}
+
+func newResponseRouter(output chan *Response) *responseRouter {
+	router := &responseRouter{channels: make(map[string]chan *Response)}
+
+	go func() {
+		for response := range output {
+			router.channel(response.Identity) <- response
+		}
+	}()
+
+	return router
+}
+
+func (r *responseRouter) channel(identity *ip.Identity) chan *Response {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	channel, ok := r.channels[identity.String()]
+	if !ok {
+		channel = make(chan *Response, 1024)
+		r.channels[identity.String()] = channel
+	}
+
+	return channel
+}
+
+// next waits for the next response for identity. It returns nil if there isn't one within a reasonable time.
+func (r *responseRouter) next(t testing.TB, identity *ip.Identity) *Response {
+	select {
+	case response := <-r.channel(identity):
+		return response
+	case <-time.After(10 * time.Second):
+		t.Errorf("timed out waiting for a response for %s", identity.String())
+		return nil
+	}
+}
+
+func newTestIdentity(t testing.TB, source string, destination string) *ip.Identity {
+	identity, identityError := ip.NewIdentityFromString(source + ":" + destination)
+	if identityError != nil {
+		t.Fatal(identityError)
+	}
+
+	return identity
+}
+
+// TestStress runs many connections through open, write, pause, resume, half-close and close at the same time.
+// It is meant to be run with -race.
+func TestStress(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	proxy := New()
+	go proxy.Run()
+	responses := newResponseRouter(proxy.PersonaOutput)
+
+	var wait sync.WaitGroup
+	for index := 0; index < 200; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+
+			identity := newTestIdentity(t, fmt.Sprintf("10.0.%d.%d:%d", index/100, index%100, 1000+index), address)
+			message := []byte(fmt.Sprintf("hello %d", index))
+
+			proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+			response := responses.next(t, identity)
+			if response == nil {
+				return
+			}
+			if response.Type != ResponseConnectSuccess {
+				t.Errorf("%s: expected connect success, got %v", identity.String(), response.Type)
+				return
+			}
+
+			proxy.PersonaInput <- &Request{RequestPause, identity, nil}
+			proxy.PersonaInput <- &Request{RequestWrite, identity, message}
+			proxy.PersonaInput <- &Request{RequestResume, identity, nil}
+			proxy.PersonaInput <- &Request{RequestCloseWrite, identity, nil}
+
+			received := make([]byte, 0)
+			for {
+				response = responses.next(t, identity)
+				if response == nil {
+					return
+				}
+				if response.Type == ResponseData {
+					received = append(received, response.Payload...)
+					continue
+				}
+
+				if response.Type != ResponseClose {
+					t.Errorf("%s: expected data or close, got %v", identity.String(), response.Type)
+					return
+				}
+
+				break
+			}
+
+			if !bytes.Equal(received, message) {
+				t.Errorf("%s: expected %q, got %q", identity.String(), message, received)
+			}
+
+			proxy.PersonaInput <- &Request{RequestClose, identity, nil}
+		}(index)
+	}
+
+	wait.Wait()
+}
+
+// TestStressAbrupt opens, writes to and closes connections without waiting for any of the responses.
+func TestStressAbrupt(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	proxy := New()
+	go proxy.Run()
+	go func() {
+		for range proxy.PersonaOutput {
+		}
+	}()
+
+	var wait sync.WaitGroup
+	for index := 0; index < 200; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+
+			identity := newTestIdentity(t, fmt.Sprintf("10.1.%d.%d:%d", index/100, index%100, 1000+index), address)
+			proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+			proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+			proxy.PersonaInput <- &Request{RequestPause, identity, nil}
+			proxy.PersonaInput <- &Request{RequestClose, identity, nil}
+		}(index)
+	}
+
+	wait.Wait()
+}
+
+// startSilentServer starts a TCP server that accepts connections but never reads from them. Each accepted connection is
+// sent on the returned channel.
+func startSilentServer(t testing.TB) (string, chan *net.TCPConn, func()) {
+	listener, listenError := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+
+	accepted := make(chan *net.TCPConn, 16)
+	go func() {
+		for {
+			conn, acceptError := listener.AcceptTCP()
+			if acceptError != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	return listener.Addr().String(), accepted, func() { _ = listener.Close() }
+}
+
+// expectClosed fails unless the proxy has closed its end of server's connection without writing out what was still
+// queued for it. Whatever the kernel had already accepted still arrives before the end of the stream, but that should
+// be far less than queued.
+func expectClosed(t testing.TB, server *net.TCPConn, queued int) {
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	received, copyError := io.Copy(io.Discard, server)
+	var netError net.Error
+	if errors.As(copyError, &netError) && netError.Timeout() {
+		t.Error("the proxy did not close the connection to the server")
+	}
+
+	if received >= int64(queued/2) {
+		t.Errorf("the proxy went on writing after it closed the connection, the server received %d of %d bytes", received, queued)
+	}
+}
+
+// fillQueue writes to identity until the proxy refuses a write. It returns the responses that the proxy sent back and
+// how much it wrote.
+func fillQueue(t testing.TB, proxy *Proxy, responses *responseRouter, identity *ip.Identity) ([]*Response, int) {
+	data := make([]byte, 65536)
+	for written := 0; written < 4096; written++ {
+		proxy.PersonaInput <- &Request{RequestWrite, identity, data}
+
+		select {
+		case response := <-responses.channel(identity):
+			return []*Response{response, responses.next(t, identity)}, written * len(data)
+		default:
+		}
+	}
+
+	t.Fatal("the write queue never filled up")
+	return nil, 0
+}
+
+// TestStalledServer checks that a connection to a server that has stopped reading is closed once its queue is full.
+func TestStalledServer(t *testing.T) {
+	address, accepted, stop := startSilentServer(t)
+	defer stop()
+
+	// Allow far more to be queued than the kernel will buffer, so that the writer is stuck waiting for the server.
+	savedLength, savedBytes := WriteQueueLength, WriteQueueBytes
+	WriteQueueLength = 1024
+	WriteQueueBytes = 32 * 1024 * 1024
+	defer func() {
+		WriteQueueLength, WriteQueueBytes = savedLength, savedBytes
+	}()
+
+	proxy := New()
+	go proxy.Run()
+	responses := newResponseRouter(proxy.PersonaOutput)
+
+	identity := newTestIdentity(t, "10.0.0.1:1000", address)
+	proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+	response := responses.next(t, identity)
+	if response == nil || response.Type != ResponseConnectSuccess {
+		t.Fatalf("expected connect success, got %v", response)
+	}
+
+	server := <-accepted
+	defer server.Close()
+
+	refused, queued := fillQueue(t, proxy, responses, identity)
+	if refused[0].Type != ResponseError || refused[1] == nil || refused[1].Type != ResponseReset {
+		t.Fatalf("expected an error and a reset, got %v", refused)
+	}
+
+	expectClosed(t, server, queued)
+}
+
+// TestWriteAfterServerClose checks that a write that fails after the server has closed its side of the connection
+// resets the connection.
+func TestWriteAfterServerClose(t *testing.T) {
+	address, accepted, stop := startSilentServer(t)
+	defer stop()
+
+	proxy := New()
+	go proxy.Run()
+	responses := newResponseRouter(proxy.PersonaOutput)
+
+	identity := newTestIdentity(t, "10.0.0.1:1000", address)
+	proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+	response := responses.next(t, identity)
+	if response == nil || response.Type != ResponseConnectSuccess {
+		t.Fatalf("expected connect success, got %v", response)
+	}
+
+	// The server sends a FIN, then resets the connection.
+	server := <-accepted
+	_ = server.CloseWrite()
+	response = responses.next(t, identity)
+	if response == nil || response.Type != ResponseClose {
+		t.Fatalf("expected a close response, got %v", response)
+	}
+	_ = server.SetLinger(0)
+	_ = server.Close()
+
+	// The first write after the reset may still be accepted by the kernel, but it can't be long before one fails.
+	for attempt := 0; attempt < 100; attempt++ {
+		proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+
+		select {
+		case response = <-responses.channel(identity):
+		case <-time.After(100 * time.Millisecond):
+			continue
+		}
+
+		// The server had already closed its side, so the failed write is not reported as an error.
+		if response.Type != ResponseReset {
+			t.Fatalf("expected a reset response, got %v", response)
+		}
+
+		// The connection is gone, so Persona can't write to it any more.
+		proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+		response = responses.next(t, identity)
+		if response == nil || response.Type != ResponseError {
+			t.Fatalf("expected an error for writing to a reset connection, got %v", response)
+		}
+		return
+	}
+
+	t.Fatal("writing to the reset connection never failed")
+}
+
+// TestStop checks that stopping the proxy closes every connection, even when nobody is taking responses any more and
+// the connection's server has stopped reading.
+func TestStop(t *testing.T) {
+	echoAddress, stopEcho := startEchoServer(t)
+	defer stopEcho()
+	silentAddress, accepted, stopSilent := startSilentServer(t)
+	defer stopSilent()
+
+	proxy := New()
+	finished := make(chan struct{})
+	go func() {
+		proxy.Run()
+		close(finished)
+	}()
+
+	echo := newTestIdentity(t, "10.0.0.1:1000", echoAddress)
+	silent := newTestIdentity(t, "10.0.0.1:1001", silentAddress)
+	for _, identity := range []*ip.Identity{echo, silent} {
+		proxy.PersonaInput <- &Request{RequestOpen, identity, nil}
+		response := <-proxy.PersonaOutput
+		if response.Type != ResponseConnectSuccess {
+			t.Fatalf("expected connect success, got %v", response)
+		}
+	}
+
+	server := <-accepted
+	defer server.Close()
+
+	// Nothing takes the echoed data, so the echo connection's reader is left waiting to deliver it.
+	proxy.PersonaInput <- &Request{RequestWrite, echo, []byte("hello")}
+	proxy.PersonaInput <- &Request{RequestWrite, silent, []byte("hello")}
+
+	proxy.Stop()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, copyError := io.Copy(io.Discard, server)
+	var netError net.Error
+	if errors.As(copyError, &netError) && netError.Timeout() {
+		t.Error("the proxy did not close the connection to the server when it was stopped")
+	}
+}
@@ -1,8 +1,12 @@
 package tcpproxy
 
 import (
+	"encoding/binary"
+	"errors"
 	"github.com/kataras/golog"
+	"net"
 	"router/ip"
+	"strconv"
 )
 
 type RequestType byte
@@ -11,6 +15,21 @@ const (
 	RequestOpen  RequestType = 1
 	RequestWrite RequestType = 2
 	RequestClose RequestType = 3
+
+	// RequestCloseWrite shuts down the sending side of the upstream connection, data from the server is still delivered.
+	RequestCloseWrite RequestType = 4
+
+	// RequestPause and RequestResume stop and restart reading from the server, so that Persona can apply back pressure.
+	RequestPause  RequestType = 5
+	RequestResume RequestType = 6
+
+	// RequestOpenWithData opens a connection and sends the rest of the request as soon as it is connected.
+	// If TCP Fast Open is enabled and supported by the kernel, the data is sent along with the SYN.
+	RequestOpenWithData RequestType = 7
+
+	// RequestOpenHostname opens a connection to a hostname that is resolved by the router instead of by the client.
+	// The rest of the request is a 2 byte big endian port followed by the hostname. The identity is only used to identify the connection.
+	RequestOpenHostname RequestType = 8
 )
 
 type Request struct {
@@ -22,25 +41,56 @@ type Request struct {
 func NewRequest(data []byte) *Request {
 	golog.Debugf("tcpproxy.NewRequest(%d bytes)", len(data))
 
-	if len(data) < 13 {
+	if len(data) < 1 {
 		return nil
 	}
 
 	typeByte := data[0]
-	identityBytes := data[1:13]
-	rest := data[13:]
+	identity, rest := ip.SplitIdentity(data[1:])
+	if identity == nil {
+		return nil
+	}
 
 	requestType := RequestType(typeByte)
-	identity := ip.NewIdentity(identityBytes)
 
 	switch requestType {
 	case RequestOpen:
 		return &Request{requestType, identity, nil}
+	case RequestOpenWithData:
+		return &Request{requestType, identity, rest}
+	case RequestOpenHostname:
+		_, hostnameError := HostnameDestination(rest)
+		if hostnameError != nil {
+			golog.Debugf("tcpproxy.NewRequest - %v", hostnameError)
+			return nil
+		}
+		return &Request{requestType, identity, rest}
 	case RequestWrite:
 		return &Request{requestType, identity, rest}
 	case RequestClose:
 		return &Request{requestType, identity, nil}
+	case RequestCloseWrite:
+		return &Request{requestType, identity, nil}
+	case RequestPause:
+		return &Request{requestType, identity, nil}
+	case RequestResume:
+		return &Request{requestType, identity, nil}
 	default:
 		return nil
 	}
 }
+
+// HostnameDestination decodes the port and hostname of a RequestOpenHostname request into a host:port string that can be dialed.
+func HostnameDestination(data []byte) (string, error) {
+	if len(data) < 3 {
+		return "", errors.New("error, hostname request is too short")
+	}
+
+	port := binary.BigEndian.Uint16(data[0:2])
+	hostname := string(data[2:])
+	if len(hostname) > 255 {
+		return "", errors.New("error, hostname is too long")
+	}
+
+	return net.JoinHostPort(hostname, strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,81 @@
+package tcpproxy
+
+import (
+	"context"
+	"github.com/kataras/golog"
+	"net"
+	"router/clock"
+	"sync"
+	"time"
+)
+
+// ResolveCacheTTL is how long hostnames from RequestOpenHostname stay cached. Go's resolver doesn't expose record TTLs,
+// so every name gets the same lifetime. ResolveCacheSize limits the number of names cached, 0 disables the cache.
+var ResolveCacheTTL = 5 * time.Minute
+var ResolveCacheSize = 1024
+
+type resolvedHost struct {
+	addresses []net.IP
+	expires   time.Time
+}
+
+var resolveCache = make(map[string]resolvedHost)
+var resolveCacheLock sync.Mutex
+
+// resolve looks up the addresses for host, using the cache when possible.
+func resolve(ctx context.Context, clock clock.Clock, host string) ([]net.IP, error) {
+	now := clock.Now()
+
+	resolveCacheLock.Lock()
+	cached, ok := resolveCache[host]
+	resolveCacheLock.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.addresses, nil
+	}
+
+	ipAddresses, lookupError := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if lookupError != nil {
+		return nil, lookupError
+	}
+
+	addresses := make([]net.IP, 0, len(ipAddresses))
+	for _, ipAddress := range ipAddresses {
+		addresses = append(addresses, ipAddress.IP)
+	}
+	golog.Debugf("resolved %s to %v", host, addresses)
+
+	resolveCacheLock.Lock()
+	_, ok = resolveCache[host]
+	if !ok && len(resolveCache) >= ResolveCacheSize {
+		makeCacheRoom(now)
+	}
+	if len(resolveCache) < ResolveCacheSize {
+		resolveCache[host] = resolvedHost{addresses, now.Add(ResolveCacheTTL)}
+	}
+	resolveCacheLock.Unlock()
+
+	return addresses, nil
+}
+
+// makeCacheRoom drops every expired name from the cache, or if none have expired, the one that expires first. It is
+// only called when the cache is full, and the caller must hold resolveCacheLock.
+func makeCacheRoom(now time.Time) {
+	oldest := ""
+	var oldestExpires time.Time
+	for name, entry := range resolveCache {
+		if now.After(entry.expires) {
+			delete(resolveCache, name)
+			continue
+		}
+
+		if oldest == "" || entry.expires.Before(oldestExpires) {
+			oldest = name
+			oldestExpires = entry.expires
+		}
+	}
+
+	if len(resolveCache) >= ResolveCacheSize && oldest != "" {
+		delete(resolveCache, oldest)
+	}
+}
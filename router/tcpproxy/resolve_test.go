@@ -0,0 +1,46 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestResolveCacheSize checks that the cache never holds more than ResolveCacheSize names, and that expired names
+// are dropped before live ones.
+func TestResolveCacheSize(t *testing.T) {
+	saved := ResolveCacheSize
+	ResolveCacheSize = 4
+	defer func() {
+		ResolveCacheSize = saved
+	}()
+
+	now := time.Unix(1000, 0)
+
+	resolveCacheLock.Lock()
+	defer resolveCacheLock.Unlock()
+
+	savedCache := resolveCache
+	resolveCache = make(map[string]resolvedHost)
+	defer func() {
+		resolveCache = savedCache
+	}()
+
+	addresses := []net.IP{net.IPv4(192, 0, 2, 1)}
+	resolveCache["expired"] = resolvedHost{addresses, now.Add(-time.Second)}
+	for index := 0; index < 3; index++ {
+		resolveCache[fmt.Sprintf("live%d", index)] = resolvedHost{addresses, now.Add(time.Duration(index+1) * time.Minute)}
+	}
+
+	makeCacheRoom(now)
+	if _, ok := resolveCache["expired"]; ok || len(resolveCache) != 3 {
+		t.Fatalf("expected only the expired name to be dropped, the cache holds %d names", len(resolveCache))
+	}
+
+	resolveCache["live3"] = resolvedHost{addresses, now.Add(time.Hour)}
+	makeCacheRoom(now)
+	if _, ok := resolveCache["live0"]; ok || len(resolveCache) != 3 {
+		t.Fatalf("expected the name that expires first to be dropped, the cache holds %d names", len(resolveCache))
+	}
+}
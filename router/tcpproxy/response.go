@@ -10,6 +10,19 @@ const (
 	ResponseError          ResponseType = 3
 	ResponseConnectSuccess ResponseType = 4
 	ResponseConnectFailure ResponseType = 5
+	ResponseReset          ResponseType = 6
+)
+
+// ConnectFailureReason is sent with ResponseConnectFailure so that Persona can answer the client with an RST or the right ICMP unreachable message.
+type ConnectFailureReason byte
+
+const (
+	ConnectFailureUnknown            ConnectFailureReason = 0
+	ConnectFailureRefused            ConnectFailureReason = 1
+	ConnectFailureHostUnreachable    ConnectFailureReason = 2
+	ConnectFailureNetworkUnreachable ConnectFailureReason = 3
+	ConnectFailureTimeout            ConnectFailureReason = 4
+	ConnectFailurePolicyDenied       ConnectFailureReason = 5
 )
 
 type Response struct {
@@ -35,8 +48,18 @@ func NewConnectSuccessResponse(identity *ip.Identity) *Response {
 	return &Response{ResponseConnectSuccess, identity, nil, nil}
 }
 
-func NewConnectFailureResponse(identity *ip.Identity) *Response {
-	return &Response{ResponseConnectFailure, identity, nil, nil}
+// NewResolvedConnectSuccessResponse is sent instead of NewConnectSuccessResponse for RequestOpenHostname requests.
+// The payload is the address that the hostname resolved to, encoded as an address family byte followed by the host and port.
+func NewResolvedConnectSuccessResponse(identity *ip.Identity, resolved []byte) *Response {
+	return &Response{ResponseConnectSuccess, identity, resolved, nil}
+}
+
+func NewConnectFailureResponse(identity *ip.Identity, reason ConnectFailureReason) *Response {
+	return &Response{ResponseConnectFailure, identity, []byte{byte(reason)}, nil}
+}
+
+func NewResetResponse(identity *ip.Identity) *Response {
+	return &Response{ResponseReset, identity, nil, nil}
 }
 
 func (r *Response) Data() ([]byte, error) {
@@ -48,12 +71,20 @@ func (r *Response) Data() ([]byte, error) {
 	result = append(result, typeByte)
 	result = append(result, identityBytes...)
 
-	// Only these two types have additional data and require additional handling, all other types are covered by the code above.
+	// Only these types have additional data and require additional handling, all other types are covered by the code above.
 	switch r.Type {
 	case ResponseData:
 		if r.Payload != nil {
 			result = append(result, r.Payload...)
 		}
+	case ResponseConnectSuccess:
+		if r.Payload != nil {
+			result = append(result, r.Payload...)
+		}
+	case ResponseConnectFailure:
+		if r.Payload != nil {
+			result = append(result, r.Payload...)
+		}
 	case ResponseError:
 		if r.Error != nil {
 			result = append(result, []byte(r.Error.Error())...)
@@ -0,0 +1,25 @@
+package tcpproxy
+
+import (
+	"net"
+	"time"
+)
+
+// KeepAlive and NoDelay apply on every platform. The other options are only supported on Linux, and are left at the
+// OS defaults when they are zero. FastOpenConnect only applies to connections opened with data.
+var KeepAlive = 15 * time.Second // negative disables keepalives
+var NoDelay = true
+var UserTimeout time.Duration
+var FastOpenConnect = false
+var CongestionControl = ""
+var DSCP = 0
+
+// setConnectionOptions applies the socket options that can only be set once the connection is established.
+func setConnectionOptions(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	return tcpConn.SetNoDelay(NoDelay)
+}
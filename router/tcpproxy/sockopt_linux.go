@@ -0,0 +1,76 @@
+//go:build linux
+
+package tcpproxy
+
+import (
+	"github.com/kataras/golog"
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// CheckSocketOptions makes sure that the kernel accepts the configured socket options, so that a bad option is
+// reported once at startup.
+func CheckSocketOptions() error {
+	socket, socketError := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if socketError != nil {
+		return socketError
+	}
+	defer func() {
+		_ = unix.Close(socket)
+	}()
+
+	return applySocketOptions(socket, "tcp4", FastOpenConnect)
+}
+
+// setSocketOptions applies the socket options that need to be set before connecting. An option that can't be set is
+// logged and skipped rather than failing the dial.
+func setSocketOptions(network string, address string, rawConn syscall.RawConn, fastOpen bool) error {
+	var optionError error
+	controlError := rawConn.Control(func(fd uintptr) {
+		optionError = applySocketOptions(int(fd), network, fastOpen)
+	})
+	if controlError != nil {
+		return controlError
+	}
+
+	if optionError != nil {
+		golog.Debugf("error setting socket options for %s - %v", address, optionError)
+	}
+
+	return nil
+}
+
+// applySocketOptions sets every configured option on socket, and returns the first error. TCP_FASTOPEN_CONNECT is only
+// set if fastOpen is too, because with a cached cookie connect returns before the handshake, and a server that speaks
+// first would wait forever for the client's first write.
+func applySocketOptions(socket int, network string, fastOpen bool) error {
+	var firstError error
+	check := func(optionError error) {
+		if optionError != nil && firstError == nil {
+			firstError = optionError
+		}
+	}
+
+	if UserTimeout > 0 {
+		check(unix.SetsockoptInt(socket, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(UserTimeout.Milliseconds())))
+	}
+
+	if FastOpenConnect && fastOpen {
+		check(unix.SetsockoptInt(socket, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1))
+	}
+
+	if CongestionControl != "" {
+		check(unix.SetsockoptString(socket, unix.IPPROTO_TCP, unix.TCP_CONGESTION, CongestionControl))
+	}
+
+	if DSCP != 0 {
+		// DSCP is the upper 6 bits of the IPv4 TOS byte and the IPv6 traffic class.
+		if network == "tcp6" {
+			check(unix.SetsockoptInt(socket, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, DSCP<<2))
+		} else {
+			check(unix.SetsockoptInt(socket, unix.IPPROTO_IP, unix.IP_TOS, DSCP<<2))
+		}
+	}
+
+	return firstError
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package tcpproxy
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"router/clock"
+	"testing"
+)
+
+// TestBadSocketOption checks that an option the kernel rejects is reported by CheckSocketOptions but doesn't stop
+// connections from being made.
+func TestBadSocketOption(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	saved := CongestionControl
+	CongestionControl = "no-such-algorithm"
+	defer func() {
+		CongestionControl = saved
+	}()
+
+	if CheckSocketOptions() == nil {
+		t.Error("expected CheckSocketOptions to reject an unknown congestion control algorithm")
+	}
+
+	conn, dialError := dial(context.Background(), clock.Real, address, false)
+	if dialError != nil {
+		t.Fatal(dialError)
+	}
+	_ = conn.Close()
+}
+
+// TestFastOpenOnlyWithData checks that TCP_FASTOPEN_CONNECT is only set on connections that are opened with data.
+func TestFastOpenOnlyWithData(t *testing.T) {
+	address, stop := startEchoServer(t)
+	defer stop()
+
+	saved := FastOpenConnect
+	FastOpenConnect = true
+	defer func() {
+		FastOpenConnect = saved
+	}()
+
+	if CheckSocketOptions() != nil {
+		t.Skip("the kernel does not support TCP_FASTOPEN_CONNECT")
+	}
+
+	for _, fastOpen := range []bool{false, true} {
+		conn, dialError := dial(context.Background(), clock.Real, address, fastOpen)
+		if dialError != nil {
+			t.Fatal(dialError)
+		}
+
+		rawConn, rawError := conn.(*net.TCPConn).SyscallConn()
+		if rawError != nil {
+			t.Fatal(rawError)
+		}
+
+		var value int
+		var optionError error
+		_ = rawConn.Control(func(fd uintptr) {
+			value, optionError = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT)
+		})
+		_ = conn.Close()
+
+		if optionError != nil {
+			t.Fatal(optionError)
+		}
+		if (value != 0) != fastOpen {
+			t.Errorf("dialing with fastOpen %v set TCP_FASTOPEN_CONNECT to %d", fastOpen, value)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package tcpproxy
+
+import (
+	"github.com/kataras/golog"
+	"syscall"
+)
+
+// CheckSocketOptions has nothing to check, because the options are ignored on this platform.
+func CheckSocketOptions() error {
+	return nil
+}
+
+// setSocketOptions only supports Linux, on other platforms these options are left at the OS defaults.
+func setSocketOptions(_ string, _ string, _ syscall.RawConn, _ bool) error {
+	if UserTimeout > 0 || FastOpenConnect || CongestionControl != "" || DSCP != 0 {
+		golog.Debug("tcpproxy socket options are only supported on Linux, ignoring them")
+	}
+
+	return nil
+}
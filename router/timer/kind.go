@@ -0,0 +1,70 @@
+package timer
+
+import "time"
+
+// Kind says which of a connection's timers a request or response is about. Each kind runs independently.
+type Kind byte
+
+const (
+	// KindRetransmission fires when a segment hasn't been acked in time and needs to be sent again.
+	KindRetransmission Kind = 1
+
+	// KindDelayedAck fires when an ack has been held back for long enough and has to be sent on its own.
+	KindDelayedAck Kind = 2
+
+	// KindPersist fires when the peer has advertised a zero window and a window probe is due.
+	KindPersist Kind = 3
+
+	// KindKeepalive fires when a connection has been idle long enough that a keepalive probe is due.
+	KindKeepalive Kind = 4
+
+	// KindTimeWait fires when a connection has spent long enough in TIME_WAIT and can be forgotten.
+	KindTimeWait Kind = 5
+)
+
+var DelayedAckTimeout = 200 * time.Millisecond // 200 milliseconds, RFC 1122 allows up to 500
+var PersistTimeout = 5 * time.Second           // 5 seconds
+var KeepaliveTimeout = 2 * time.Hour           // 2 hours, the RFC 1122 default
+var TimeWaitTimeout = 60 * time.Second         // 2 MSL, with an MSL of 30 seconds
+
+func (k Kind) Valid() bool {
+	switch k {
+	case KindRetransmission, KindDelayedAck, KindPersist, KindKeepalive, KindTimeWait:
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultDuration is used when a request for a timer of this kind doesn't give a duration.
+func (k Kind) DefaultDuration() time.Duration {
+	switch k {
+	case KindDelayedAck:
+		return DelayedAckTimeout
+	case KindPersist:
+		return PersistTimeout
+	case KindKeepalive:
+		return KeepaliveTimeout
+	case KindTimeWait:
+		return TimeWaitTimeout
+	default:
+		return TcpRetransmissionTimeout
+	}
+}
+
+func (k Kind) String() string {
+	switch k {
+	case KindRetransmission:
+		return "retransmission"
+	case KindDelayedAck:
+		return "delayed ack"
+	case KindPersist:
+		return "persist"
+	case KindKeepalive:
+		return "keepalive"
+	case KindTimeWait:
+		return "time wait"
+	default:
+		return "unknown"
+	}
+}
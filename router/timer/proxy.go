@@ -2,60 +2,203 @@ package timer
 
 import (
 	"github.com/kataras/golog"
+	"router/clock"
+	"router/ip"
+	"sync"
 	"time"
 )
 
 /*
-The timer subsystem handles TCP retransmission timers for Persona.
-When a new timer subsystem message is received from Persona, if there is not such timer then a new
-timer is set. If there is an existing timer, it is reset.
-When a timer fires, a response is sent to Persona.
-There is no way to cancel timers, as there is no need to do so.
+The timer subsystem handles TCP timers for Persona.
+Each connection can have one timer of each kind running at once: retransmission, delayed ack, persist, keepalive and
+TIME_WAIT. Persona can set a timer, reset a running timer or cancel it. Each request carries its own duration.
+When a timer fires, a response is sent to Persona and the timer is removed, so every set or reset of a timer produces
+exactly one response unless it is cancelled or replaced first.
 Timers that fire for segments that have already been acked are ignored by Persona.
+
+All timers are run by the goroutine running Run, using a timing wheel. The wheel's ticker only runs while there are
+timers waiting, so an idle session doesn't wake up at all. Stop ends the session, dropping any timers that are still
+running.
 */
 
 var TcpRetransmissionTimeout = 3 * time.Second // 3 seconds
 
+type Timer struct {
+	Identity   *ip.Identity
+	Kind       Kind
+	LowerBound uint32
+
+	// Position in the wheel, managed by Wheel.
+	slot      int
+	rounds    int
+	scheduled bool
+}
+
 type Proxy struct {
-	Timers        map[string]*time.Timer
+	Timers        map[string]*Timer
 	PersonaInput  chan *Request
 	PersonaOutput chan *Response
+
+	// Clock is used to drive the wheel. It can be replaced before Run is called.
+	Clock clock.Clock
+
+	wheel    *Wheel
+	ticker   clock.Ticker
+	lastTick time.Time
+
+	syncRequests chan chan struct{}
+
+	done    chan struct{} // closed by Stop
+	stopped sync.Once
 }
 
 func New() *Proxy {
-	timers := make(map[string]*time.Timer)
+	timers := make(map[string]*Timer)
 	input := make(chan *Request)
 	output := make(chan *Response)
+	wheel := NewWheel(WheelTick, WheelSize)
+	syncRequests := make(chan chan struct{})
+	done := make(chan struct{})
 
-	return &Proxy{timers, input, output}
+	return &Proxy{timers, input, output, clock.Real, wheel, nil, time.Time{}, syncRequests, done, sync.Once{}}
 }
 
 func (p *Proxy) Run() {
 	golog.Debug("timer.Proxy.Run()")
 	for {
 		golog.Debug("timer.Proxy.Run - main loop, waiting for message on channel input")
-		// Read a new timer request. A timer request either sets a new timer or resets an existing timer.
-		request := <-p.PersonaInput
-		golog.Debug("timer.Proxy.Run - PersonaInput")
-		golog.Debug("timer.Proxy.Run - RequestOpen")
-		timer, ok := p.Timers[request.Identity.String()]
+
+		// Receiving from a nil channel blocks forever, so the tick case is disabled while the wheel is empty.
+		var ticks <-chan time.Time
+		if p.ticker != nil {
+			ticks = p.ticker.C()
+		}
+
+		select {
+		case request := <-p.PersonaInput:
+			golog.Debug("timer.Proxy.Run - PersonaInput")
+			p.handleRequest(request)
+
+		case now := <-ticks:
+			p.advance(now)
+
+		case done := <-p.syncRequests:
+			// A tick that is already waiting is handled first, so that it is finished with too.
+			select {
+			case now := <-ticks:
+				p.advance(now)
+			default:
+			}
+			p.updateTicker()
+			close(done)
+
+		case <-p.done:
+			golog.Debug("timer.Proxy.Run - stopped")
+			if p.ticker != nil {
+				p.ticker.Stop()
+				p.ticker = nil
+			}
+			return
+		}
+
+		p.updateTicker()
+	}
+}
+
+// Stop stops Run. Nothing more is sent to PersonaOutput once Stop has been called.
+func (p *Proxy) Stop() {
+	p.stopped.Do(func() {
+		close(p.done)
+	})
+}
+
+// sync waits until Run has finished with every request and tick that has already been delivered to it. Tests use it
+// after advancing a fake clock, instead of waiting for an arbitrary time.
+func (p *Proxy) sync() {
+	done := make(chan struct{})
+	p.syncRequests <- done
+	<-done
+}
+
+func (p *Proxy) handleRequest(request *Request) {
+	// The wheel counts from its last tick, so bring it up to date first, in case Run was held up.
+	if p.ticker != nil {
+		p.advance(p.Clock.Now())
+	}
+
+	key := timerKey(request.Identity, request.Kind)
+	timer, ok := p.Timers[key]
+
+	switch request.Operation {
+	case OperationCancel:
+		if ok {
+			p.wheel.Remove(timer)
+			delete(p.Timers, key)
+		}
+
+	case OperationReset:
 		if ok {
-			timer.Reset(TcpRetransmissionTimeout)
-			continue
-		} else {
-			timer := time.NewTimer(TcpRetransmissionTimeout)
-			golog.Debugf("new timer for %s, %v : %v", request.Identity, TcpRetransmissionTimeout, time.Now().Unix())
-			p.Timers[request.Identity.String()] = timer
-
-			// Start a goroutine to wait on the time.
-			go func() {
-				// Wait for the timer to fire by reading from the timer's channel.
-				<-timer.C
-				golog.Debugf("timer trigger for %s, %v : %v", request.Identity, TcpRetransmissionTimeout, time.Now().Unix())
-
-				// Send a timer firing message to Persona. Persona will ignore timers that are out of date.
-				p.PersonaOutput <- NewResponse(request.Identity, request.LowerBound)
-			}()
+			p.arm(key, timer, request.Duration)
+			return
 		}
+
+		// There is no timer to reset, so set a new one.
+		p.arm(key, &Timer{Identity: request.Identity, Kind: request.Kind, LowerBound: request.LowerBound}, request.Duration)
+
+	case OperationSet:
+		if ok {
+			timer.LowerBound = request.LowerBound
+			p.arm(key, timer, request.Duration)
+			return
+		}
+
+		p.arm(key, &Timer{Identity: request.Identity, Kind: request.Kind, LowerBound: request.LowerBound}, request.Duration)
+	}
+}
+
+func timerKey(identity *ip.Identity, kind Kind) string {
+	return identity.String() + "/" + kind.String()
+}
+
+// arm starts or restarts a timer.
+func (p *Proxy) arm(key string, timer *Timer, duration time.Duration) {
+	now := p.Clock.Now()
+	golog.Debugf("timer for %s, %v : %v", key, duration, now.Unix())
+
+	// An empty wheel has no ticker, so it can start counting again from now.
+	if p.ticker == nil {
+		p.lastTick = now
+	}
+
+	p.wheel.Remove(timer)
+	p.wheel.Add(timer, duration+now.Sub(p.lastTick))
+	p.Timers[key] = timer
+}
+
+// advance moves the wheel on by however many ticks have passed, which may be more than one if Run was held up.
+func (p *Proxy) advance(now time.Time) {
+	for !now.Before(p.lastTick.Add(WheelTick)) {
+		p.lastTick = p.lastTick.Add(WheelTick)
+
+		for _, timer := range p.wheel.Advance() {
+			delete(p.Timers, timerKey(timer.Identity, timer.Kind))
+			golog.Debugf("%v timer trigger for %s, %v", timer.Kind, timer.Identity, p.Clock.Now().Unix())
+
+			// Send a timer firing message to Persona. Persona will ignore timers that are out of date.
+			select {
+			case p.PersonaOutput <- NewResponse(timer.Identity, timer.Kind, timer.LowerBound):
+			case <-p.done:
+			}
+		}
+	}
+}
+
+// updateTicker starts the ticker when the first timer is added and stops it again when the last timer is gone.
+func (p *Proxy) updateTicker() {
+	if p.wheel.Len() > 0 && p.ticker == nil {
+		p.ticker = p.Clock.NewTicker(WheelTick)
+	} else if p.wheel.Len() == 0 && p.ticker != nil {
+		p.ticker.Stop()
+		p.ticker = nil
 	}
 }
@@ -0,0 +1,196 @@
+package timer
+
+import (
+	"router/clock"
+	"router/ip"
+	"testing"
+	"time"
+)
+
+// newTestProxy starts a proxy with a fake clock. Its output is buffered, so that once sync has returned every response
+// that Run has sent is waiting there.
+func newTestProxy(t testing.TB) (*Proxy, *clock.Fake) {
+	fake := clock.NewFake(time.Unix(1000, 0))
+	proxy := New()
+	proxy.Clock = fake
+	proxy.PersonaOutput = make(chan *Response, 1024)
+	go proxy.Run()
+
+	return proxy, fake
+}
+
+func newTestIdentity(t testing.TB) *ip.Identity {
+	identity, identityError := ip.NewIdentityFromString("10.0.0.1:5000:192.0.2.1:80")
+	if identityError != nil {
+		t.Fatal(identityError)
+	}
+
+	return identity
+}
+
+// advanceUntilResponse moves the clock on one tick at a time until a timer fires. It returns the response and how
+// far the clock moved.
+func advanceUntilResponse(t testing.TB, proxy *Proxy, fake *clock.Fake, limit time.Duration) (*Response, time.Duration) {
+	// Make sure that Run has finished with any requests before the clock moves.
+	proxy.sync()
+
+	start := fake.Now()
+	for fake.Now().Sub(start) <= limit {
+		fake.Advance(WheelTick)
+		proxy.sync()
+
+		select {
+		case response := <-proxy.PersonaOutput:
+			return response, fake.Now().Sub(start)
+		default:
+		}
+	}
+
+	t.Fatalf("no timer fired within %v", limit)
+	return nil, 0
+}
+
+// expectNoResponse moves the clock on by duration, one tick at a time, and fails if a timer fires.
+func expectNoResponse(t testing.TB, proxy *Proxy, fake *clock.Fake, duration time.Duration) {
+	// Make sure that Run has finished with any requests before the clock moves.
+	proxy.sync()
+
+	start := fake.Now()
+	for fake.Now().Sub(start) < duration {
+		fake.Advance(WheelTick)
+		proxy.sync()
+
+		select {
+		case response := <-proxy.PersonaOutput:
+			t.Fatalf("unexpected %v timer fired after %v", response.Kind, fake.Now().Sub(start))
+		default:
+		}
+	}
+}
+
+func TestTimerFires(t *testing.T) {
+	proxy, fake := newTestProxy(t)
+	identity := newTestIdentity(t)
+
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindRetransmission, 3 * time.Second, 7}
+
+	response, elapsed := advanceUntilResponse(t, proxy, fake, 10*time.Second)
+	if response.Kind != KindRetransmission || response.LowerBound != 7 || response.Identity.String() != identity.String() {
+		t.Errorf("unexpected response %v", response)
+	}
+	if elapsed < 3*time.Second || elapsed > 3*time.Second+10*WheelTick {
+		t.Errorf("expected the timer to fire after 3s, it fired after %v", elapsed)
+	}
+}
+
+func TestTimerReset(t *testing.T) {
+	proxy, fake := newTestProxy(t)
+	identity := newTestIdentity(t)
+
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindRetransmission, 3 * time.Second, 7}
+	expectNoResponse(t, proxy, fake, 2*time.Second)
+
+	// A reset keeps the lower bound of the running timer.
+	proxy.PersonaInput <- &Request{identity, OperationReset, KindRetransmission, 3 * time.Second, 99}
+
+	response, elapsed := advanceUntilResponse(t, proxy, fake, 10*time.Second)
+	if response.LowerBound != 7 {
+		t.Errorf("expected the reset to keep lower bound 7, got %d", response.LowerBound)
+	}
+	if elapsed < 3*time.Second-10*WheelTick {
+		t.Errorf("expected the reset timer to fire 3s after the reset, it fired after %v", elapsed)
+	}
+}
+
+func TestTimerCancel(t *testing.T) {
+	proxy, fake := newTestProxy(t)
+	identity := newTestIdentity(t)
+
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindRetransmission, 3 * time.Second, 7}
+	expectNoResponse(t, proxy, fake, time.Second)
+
+	proxy.PersonaInput <- &Request{identity, OperationCancel, KindRetransmission, 0, 0}
+
+	// With no timers left, Run stops the wheel's ticker.
+	proxy.sync()
+	if fake.Waiting() != 0 {
+		t.Fatal("expected the timer wheel to stop")
+	}
+
+	expectNoResponse(t, proxy, fake, 5*time.Second)
+}
+
+func TestTimerKinds(t *testing.T) {
+	proxy, fake := newTestProxy(t)
+	identity := newTestIdentity(t)
+
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindKeepalive, 2 * time.Second, 1}
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindRetransmission, time.Second, 2}
+	proxy.PersonaInput <- &Request{identity, OperationCancel, KindRetransmission, 0, 0}
+
+	// Cancelling the retransmission timer leaves the keepalive timer on the same connection running.
+	response, _ := advanceUntilResponse(t, proxy, fake, 10*time.Second)
+	if response.Kind != KindKeepalive || response.LowerBound != 1 {
+		t.Errorf("expected the keepalive timer to fire, got %v", response)
+	}
+}
+
+// TestTimerAfterDelay checks that a timer set while the wheel has fallen behind the clock, because Run was held up, is
+// still counted from the current time.
+func TestTimerAfterDelay(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1000, 0))
+	proxy := New()
+	proxy.Clock = fake
+	proxy.PersonaOutput = make(chan *Response, 16)
+	identity := newTestIdentity(t)
+
+	proxy.handleRequest(&Request{identity, OperationSet, KindKeepalive, time.Hour, 1})
+	proxy.updateTicker()
+
+	// The wheel isn't advanced for 5 seconds, as if Run had been blocked.
+	fake.Advance(5 * time.Second)
+	start := fake.Now()
+	proxy.handleRequest(&Request{identity, OperationSet, KindRetransmission, time.Second, 2})
+
+	proxy.advance(start.Add(time.Second - WheelTick))
+	if len(proxy.PersonaOutput) != 0 {
+		t.Fatalf("the timer fired early, %v after it was set", time.Second-WheelTick)
+	}
+
+	proxy.advance(start.Add(time.Second + WheelTick))
+	if len(proxy.PersonaOutput) != 1 {
+		t.Fatalf("expected the timer to fire after %v", time.Second)
+	}
+}
+
+// TestStop checks that Run returns and stops its ticker when the proxy is stopped, even while a timer that has fired
+// is waiting for Persona to take it.
+func TestStop(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1000, 0))
+	proxy := New()
+	proxy.Clock = fake
+	finished := make(chan struct{})
+	go func() {
+		proxy.Run()
+		close(finished)
+	}()
+
+	identity := newTestIdentity(t)
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindRetransmission, 3 * time.Second, 7}
+	proxy.PersonaInput <- &Request{identity, OperationSet, KindKeepalive, time.Hour, 7}
+	fake.BlockUntil(1)
+
+	// Nothing takes the response, so Run is left waiting to send it.
+	fake.Advance(4 * time.Second)
+
+	proxy.Stop()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+
+	if fake.Waiting() != 0 {
+		t.Errorf("expected the ticker to be stopped, %d still waiting", fake.Waiting())
+	}
+}
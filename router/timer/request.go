@@ -2,23 +2,66 @@ package timer
 
 import "router/ip"
 import "encoding/binary"
+import "time"
+
+/*
+A timer request is an identity followed by an operation, the kind of timer, a duration in milliseconds and a lower
+bound sequence number:
+
+	[identity][1 byte operation][1 byte kind][4 byte duration][4 byte lower bound]
+
+A duration of 0 means the default duration for the kind. Cancel requests ignore the duration and lower bound.
+*/
+
+type Operation byte
+
+const (
+	// OperationSet arms a timer with the given lower bound and duration, replacing any timer that is already running.
+	OperationSet Operation = 1
+
+	// OperationReset re-arms a running timer with the given duration but keeps its lower bound.
+	// If there is no running timer, it behaves like OperationSet.
+	OperationReset Operation = 2
+
+	// OperationCancel stops a running timer without sending a response.
+	OperationCancel Operation = 3
+)
 
 type Request struct {
 	Identity   *ip.Identity
+	Operation  Operation
+	Kind       Kind
+	Duration   time.Duration
 	LowerBound uint32
 }
 
+// requestLength is the length of a request after the identity.
+const requestLength = 10
+
 func NewRequest(data []byte) *Request {
-	if len(data) < 16 {
+	identity, rest := ip.SplitIdentity(data)
+	if identity == nil || len(rest) != requestLength {
 		return nil
 	}
 
-	identityBytes := data[0:12]
-	rest := data[12:]
+	operation := Operation(rest[0])
+	switch operation {
+	case OperationSet, OperationReset, OperationCancel:
+	default:
+		return nil
+	}
 
-	identity := ip.NewIdentity(identityBytes)
+	kind := Kind(rest[1])
+	if !kind.Valid() {
+		return nil
+	}
+
+	duration := time.Duration(binary.BigEndian.Uint32(rest[2:6])) * time.Millisecond
+	if duration == 0 {
+		duration = kind.DefaultDuration()
+	}
 
-	sequenceNumber := binary.BigEndian.Uint32(rest)
+	sequenceNumber := binary.BigEndian.Uint32(rest[6:10])
 
-	return &Request{identity, sequenceNumber}
+	return &Request{identity, operation, kind, duration, sequenceNumber}
 }
@@ -0,0 +1,53 @@
+package timer
+
+import (
+	"router/ip"
+	"testing"
+	"time"
+)
+
+func TestNewRequest(t *testing.T) {
+	identity, identityError := ip.NewIdentityFromString("10.0.0.1:5000:192.0.2.1:80")
+	if identityError != nil {
+		t.Fatal(identityError)
+	}
+
+	request := func(fields ...byte) []byte {
+		return append(append([]byte{}, identity.Data...), fields...)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected *Request
+	}{
+		{"set", request(1, 1, 0, 0, 0x0b, 0xb8, 0, 0, 0, 7), &Request{identity, OperationSet, KindRetransmission, 3 * time.Second, 7}},
+		{"default duration", request(2, 4, 0, 0, 0, 0, 0, 0, 1, 0), &Request{identity, OperationReset, KindKeepalive, KeepaliveTimeout, 256}},
+		{"cancel", request(3, 2, 0, 0, 0, 0, 0, 0, 0, 0), &Request{identity, OperationCancel, KindDelayedAck, DelayedAckTimeout, 0}},
+		{"lower bound only", request(0, 0, 0, 7), nil},
+		{"no kind", request(1, 0, 0, 0x0b, 0xb8, 0, 0, 0, 7), nil},
+		{"trailing data", request(1, 1, 0, 0, 0x0b, 0xb8, 0, 0, 0, 7, 0), nil},
+		{"unknown operation", request(4, 1, 0, 0, 0x0b, 0xb8, 0, 0, 0, 7), nil},
+		{"unknown kind", request(1, 6, 0, 0, 0x0b, 0xb8, 0, 0, 0, 7), nil},
+		{"no identity", []byte{1, 1, 0, 0, 0x0b, 0xb8, 0, 0, 0, 7}, nil},
+	}
+
+	for _, test := range tests {
+		parsed := NewRequest(test.data)
+		if test.expected == nil {
+			if parsed != nil {
+				t.Errorf("%s: expected nil, got %v", test.name, parsed)
+			}
+			continue
+		}
+
+		if parsed == nil {
+			t.Errorf("%s: expected %v, got nil", test.name, test.expected)
+			continue
+		}
+
+		if parsed.Identity.String() != identity.String() || parsed.Operation != test.expected.Operation || parsed.Kind != test.expected.Kind || parsed.Duration != test.expected.Duration || parsed.LowerBound != test.expected.LowerBound {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, parsed)
+		}
+	}
+}
@@ -5,13 +5,20 @@ import (
 	"router/ip"
 )
 
+/*
+A timer response is the identity, the lower bound sequence number and the kind of the timer that fired:
+
+	[identity][4 byte lower bound][1 byte kind]
+*/
+
 type Response struct {
 	Identity   *ip.Identity
+	Kind       Kind
 	LowerBound uint32
 }
 
-func NewResponse(identity *ip.Identity, lowerBound uint32) *Response {
-	return &Response{identity, lowerBound}
+func NewResponse(identity *ip.Identity, kind Kind, lowerBound uint32) *Response {
+	return &Response{identity, kind, lowerBound}
 }
 
 func (r *Response) Data() ([]byte, error) {
@@ -21,6 +28,7 @@ func (r *Response) Data() ([]byte, error) {
 	result := make([]byte, 0)
 	result = append(result, r.Identity.Data...)
 	result = append(result, sequenceNumberBytes...)
+	result = append(result, byte(r.Kind))
 
 	return result, nil
 }
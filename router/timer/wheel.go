@@ -0,0 +1,80 @@
+package timer
+
+import "time"
+
+var WheelTick = 10 * time.Millisecond
+var WheelSize = 512
+
+// Wheel is a hashed timing wheel of WheelSize slots, each WheelTick long. A timer further away than one turn of the
+// wheel waits in its slot for the remaining rounds. Timers fire up to one tick late.
+type Wheel struct {
+	tick    time.Duration
+	slots   []map[*Timer]struct{}
+	current int
+	count   int
+}
+
+func NewWheel(tick time.Duration, size int) *Wheel {
+	if size < 1 {
+		size = 1
+	}
+
+	slots := make([]map[*Timer]struct{}, size)
+	for index := range slots {
+		slots[index] = make(map[*Timer]struct{})
+	}
+
+	return &Wheel{tick, slots, 0, 0}
+}
+
+// Add schedules a timer to fire duration after the wheel's last tick, rounded up to a whole number of ticks. The timer
+// must not already be in the wheel.
+func (w *Wheel) Add(timer *Timer, duration time.Duration) {
+	ticks := int((duration + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	timer.slot = (w.current + ticks) % len(w.slots)
+	timer.rounds = (ticks - 1) / len(w.slots)
+	timer.scheduled = true
+
+	w.slots[timer.slot][timer] = struct{}{}
+	w.count = w.count + 1
+}
+
+// Remove takes a timer out of the wheel. It does nothing if the timer is not in the wheel.
+func (w *Wheel) Remove(timer *Timer) {
+	if !timer.scheduled {
+		return
+	}
+
+	delete(w.slots[timer.slot], timer)
+	timer.scheduled = false
+	w.count = w.count - 1
+}
+
+// Advance moves the wheel on by one tick and returns the timers that have expired, which are removed from the wheel.
+func (w *Wheel) Advance() []*Timer {
+	w.current = (w.current + 1) % len(w.slots)
+
+	expired := make([]*Timer, 0)
+	for timer := range w.slots[w.current] {
+		if timer.rounds > 0 {
+			timer.rounds = timer.rounds - 1
+			continue
+		}
+
+		expired = append(expired, timer)
+	}
+
+	for _, timer := range expired {
+		w.Remove(timer)
+	}
+
+	return expired
+}
+
+func (w *Wheel) Len() int {
+	return w.count
+}
@@ -0,0 +1,203 @@
+package timer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWheelFiresOnTime(t *testing.T) {
+	wheel := NewWheel(10*time.Millisecond, 512)
+	timer := &Timer{}
+	wheel.Add(timer, 25*time.Millisecond)
+
+	for tick := 1; tick <= 2; tick++ {
+		if len(wheel.Advance()) != 0 {
+			t.Fatalf("timer fired early, after %d ticks", tick)
+		}
+	}
+
+	expired := wheel.Advance()
+	if len(expired) != 1 || expired[0] != timer {
+		t.Fatalf("expected the timer to fire after 3 ticks, got %v", expired)
+	}
+
+	if wheel.Len() != 0 {
+		t.Errorf("expected an empty wheel, got %d timers", wheel.Len())
+	}
+}
+
+// TestWheelRounds checks a timer that is due many turns of the wheel from now, like a 2 hour keepalive on a wheel
+// that only covers 5.12 seconds.
+func TestWheelRounds(t *testing.T) {
+	wheel := NewWheel(10*time.Millisecond, 512)
+
+	// Move the wheel off slot 0, so that the timer's slot wraps around the end of the ring.
+	for tick := 0; tick < 500; tick++ {
+		wheel.Advance()
+	}
+
+	keepalive := &Timer{Kind: KindKeepalive}
+	short := &Timer{Kind: KindRetransmission}
+	wheel.Add(keepalive, 2*time.Hour)
+	wheel.Add(short, 3*time.Second)
+
+	due := int(2 * time.Hour / (10 * time.Millisecond))
+	for tick := 1; tick < due; tick++ {
+		for _, timer := range wheel.Advance() {
+			if timer == keepalive {
+				t.Fatalf("keepalive fired early, after %d of %d ticks", tick, due)
+			}
+		}
+	}
+
+	expired := wheel.Advance()
+	if len(expired) != 1 || expired[0] != keepalive {
+		t.Fatalf("expected the keepalive to fire after %d ticks, got %v", due, expired)
+	}
+}
+
+func TestWheelRemove(t *testing.T) {
+	wheel := NewWheel(10*time.Millisecond, 4)
+	timer := &Timer{}
+	wheel.Add(timer, 100*time.Millisecond)
+	wheel.Remove(timer)
+	wheel.Remove(timer)
+
+	if wheel.Len() != 0 {
+		t.Fatalf("expected an empty wheel, got %d timers", wheel.Len())
+	}
+
+	for tick := 0; tick < 20; tick++ {
+		if len(wheel.Advance()) != 0 {
+			t.Fatalf("removed timer fired after %d ticks", tick+1)
+		}
+	}
+}
+
+var benchmarkIdentities = []int{1000, 10000, 100000}
+
+// BenchmarkWheelReset resets one of many running timers per operation, which is what every ack does.
+func BenchmarkWheelReset(b *testing.B) {
+	for _, count := range benchmarkIdentities {
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			wheel := NewWheel(WheelTick, WheelSize)
+			timers := make([]*Timer, count)
+			for index := range timers {
+				timers[index] = &Timer{}
+				wheel.Add(timers[index], TcpRetransmissionTimeout)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for index := 0; index < b.N; index++ {
+				timer := timers[index%count]
+				wheel.Remove(timer)
+				wheel.Add(timer, TcpRetransmissionTimeout)
+			}
+		})
+	}
+}
+
+// BenchmarkTimeTimerReset does the same as BenchmarkWheelReset with a time.Timer for each identity, as the timer
+// subsystem used to.
+func BenchmarkTimeTimerReset(b *testing.B) {
+	for _, count := range benchmarkIdentities {
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			timers := make([]*time.Timer, count)
+			for index := range timers {
+				timers[index] = time.AfterFunc(TcpRetransmissionTimeout, func() {})
+			}
+			defer func() {
+				for _, timer := range timers {
+					timer.Stop()
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for index := 0; index < b.N; index++ {
+				timers[index%count].Reset(TcpRetransmissionTimeout)
+			}
+		})
+	}
+}
+
+// BenchmarkWheelSet sets timers for new identities until there are count of them, then starts again.
+func BenchmarkWheelSet(b *testing.B) {
+	for _, count := range benchmarkIdentities {
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			wheel := NewWheel(WheelTick, WheelSize)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for index := 0; index < b.N; index++ {
+				if index%count == 0 {
+					wheel = NewWheel(WheelTick, WheelSize)
+				}
+
+				wheel.Add(&Timer{}, TcpRetransmissionTimeout)
+			}
+		})
+	}
+}
+
+// BenchmarkTimeTimerSet does the same as BenchmarkWheelSet with a time.Timer and a waiting goroutine for each
+// identity, as the timer subsystem used to.
+func BenchmarkTimeTimerSet(b *testing.B) {
+	for _, count := range benchmarkIdentities {
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			done := make(chan struct{})
+			timers := make([]*time.Timer, 0, count)
+			stop := func() {
+				close(done)
+				for _, timer := range timers {
+					timer.Stop()
+				}
+				timers = timers[:0]
+				done = make(chan struct{})
+			}
+			defer stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for index := 0; index < b.N; index++ {
+				if index%count == 0 {
+					stop()
+				}
+
+				timer := time.NewTimer(TcpRetransmissionTimeout)
+				timers = append(timers, timer)
+				go func(done chan struct{}) {
+					select {
+					case <-timer.C:
+					case <-done:
+					}
+				}(done)
+			}
+		})
+	}
+}
+
+// BenchmarkWheelAdvance measures one tick of a wheel holding count timers.
+func BenchmarkWheelAdvance(b *testing.B) {
+	for _, count := range benchmarkIdentities {
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			wheel := NewWheel(WheelTick, WheelSize)
+			for index := 0; index < count; index++ {
+				wheel.Add(&Timer{}, KeepaliveTimeout)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for index := 0; index < b.N; index++ {
+				wheel.Advance()
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package udpproxy
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// BatchSize is the most datagrams that are read or written with one system call. A flow's read batch starts at one
+// datagram and doubles whenever a read fills it, up to BatchSize.
+var BatchSize = 16
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn.
+type batchConn interface {
+	ReadBatch(messages []ipv4.Message, flags int) (int, error)
+	WriteBatch(messages []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	localAddress, ok := conn.LocalAddr().(*net.UDPAddr)
+	if ok && localAddress.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+
+	return ipv4.NewPacketConn(conn)
+}
+
+// MinReadSize is the size of each of a flow's receive buffers when it is opened. A flow that receives a datagram too
+// large for its buffers drops that datagram and switches to buffers large enough for any datagram.
+var MinReadSize = 2048
+
+// readBatch is a flow's batch of receive buffers, all of the same size.
+type readBatch struct {
+	messages []ipv4.Message
+	size     int
+}
+
+func newReadBatch() *readBatch {
+	batch := &readBatch{make([]ipv4.Message, 0, BatchSize), MinReadSize}
+	batch.add()
+
+	return batch
+}
+
+func (b *readBatch) add() {
+	b.messages = append(b.messages, ipv4.Message{Buffers: [][]byte{make([]byte, b.size)}})
+}
+
+// truncate drops every buffer after the first size.
+func (b *readBatch) truncate(size int) {
+	for index := size; index < len(b.messages); index++ {
+		b.messages[index] = ipv4.Message{}
+	}
+
+	b.messages = b.messages[:size]
+}
+
+// grow replaces every buffer with one that is large enough for any datagram.
+func (b *readBatch) grow() {
+	if b.size >= MaxDatagramSize {
+		return
+	}
+
+	count := len(b.messages)
+	b.size = MaxDatagramSize
+	b.truncate(0)
+	for len(b.messages) < count {
+		b.add()
+	}
+}
+
+// resize grows or shrinks the batch depending on how many datagrams the last read returned.
+func (b *readBatch) resize(count int) {
+	if count == len(b.messages) && len(b.messages) < BatchSize {
+		size := len(b.messages) * 2
+		if size > BatchSize {
+			size = BatchSize
+		}
+
+		for len(b.messages) < size {
+			b.add()
+		}
+	} else if count <= 1 && len(b.messages) > 1 {
+		b.truncate(len(b.messages) / 2)
+	}
+}
+
+// truncated reports whether a datagram was too large for the buffer that it was read into.
+func truncated(message ipv4.Message) bool {
+	if msgTrunc != 0 {
+		return message.Flags&msgTrunc != 0
+	}
+
+	return message.N == len(message.Buffers[0]) && message.N < MaxDatagramSize
+}
@@ -0,0 +1,104 @@
+package udpproxy
+
+import (
+	"net"
+	"router/ip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow is the proxy's record of one upstream UDP socket.
+type Flow struct {
+	lastUsed int64 // Unix nanoseconds, accessed atomically, see touch and LastUsed
+
+	Identity *ip.Identity // the identity that created the flow
+	Conn     *net.UDPConn
+	Batch    batchConn
+	Timeout  time.Duration // how long the flow can go unused before it is closed
+
+	// In full cone mode several identities can share a flow. The first one is sent the datagrams that don't match any
+	// identity's destination. ReadFromServer reads this list, so it is guarded by lock.
+	lock       sync.Mutex
+	identities []*ip.Identity
+}
+
+func NewFlow(identity *ip.Identity, conn *net.UDPConn, now time.Time) *Flow {
+	flow := &Flow{Identity: identity, Conn: conn, Batch: newBatchConn(conn), Timeout: TimeoutForPort(identity.DestinationPort()), identities: []*ip.Identity{identity}}
+	flow.touch(now)
+
+	return flow
+}
+
+// touch records that the flow carried a datagram in either direction at now.
+func (f *Flow) touch(now time.Time) {
+	atomic.StoreInt64(&f.lastUsed, now.UnixNano())
+}
+
+func (f *Flow) LastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastUsed))
+}
+
+// Add records that identity shares the flow. The flow lasts as long as the longest timeout of the identities using it.
+func (f *Flow) Add(identity *ip.Identity) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, shared := range f.identities {
+		if shared.String() == identity.String() {
+			return
+		}
+	}
+
+	f.identities = append(f.identities, identity)
+
+	timeout := TimeoutForPort(identity.DestinationPort())
+	if timeout > f.Timeout {
+		f.Timeout = timeout
+	}
+}
+
+// Remove stops identity from sharing the flow. It returns false if identity wasn't using the flow.
+func (f *Flow) Remove(identity *ip.Identity) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for index, shared := range f.identities {
+		if shared.String() == identity.String() {
+			f.identities = append(f.identities[:index], f.identities[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Identities returns every identity that shares the flow.
+func (f *Flow) Identities() []*ip.Identity {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	identities := make([]*ip.Identity, len(f.identities))
+	copy(identities, f.identities)
+
+	return identities
+}
+
+// route finds the identity to deliver a datagram from source to. It returns false if no identity has source as its
+// destination, in which case the identity is the first one sharing the flow, or nil if there are none left.
+func (f *Flow) route(source string) (*ip.Identity, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, identity := range f.identities {
+		if identity.Destination == source {
+			return identity, true
+		}
+	}
+
+	if len(f.identities) == 0 {
+		return nil, false
+	}
+
+	return f.identities[0], false
+}
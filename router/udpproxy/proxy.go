@@ -3,126 +3,403 @@ package udpproxy
 import (
 	"errors"
 	"github.com/kataras/golog"
+	"golang.org/x/net/ipv4"
 	"net"
+	"router/clock"
 	"router/ip"
-	"time"
+	"sync"
 )
 
+/*
+By default each identity gets its own connected UDP socket, and only datagrams from the identity's destination are
+delivered to Persona. This is how a symmetric NAT behaves.
+
+In full cone mode, all of the datagrams that a client sends from one source address and port share a single unconnected
+UDP socket, no matter where they are sent, and datagrams from any remote are delivered to Persona. This is an
+endpoint-independent mapping, which STUN, WebRTC and other peer-to-peer protocols rely on. Datagrams from remotes other
+than the identity's destination are sent to Persona as ResponseDataFrom, which carries their actual source. Every
+identity that uses the socket is told when it closes, and the socket stays open until the last of them has closed it.
+*/
+
+var FullCone = false
+
+// MaxDatagramSize is the largest possible UDP payload.
+const MaxDatagramSize = 65535
+
+/*
+The Flows map is owned by the goroutine running Run. Other goroutines never touch it directly.
+ReadFromServer goroutines report that their socket has failed on the failed channel, and expired flows are closed by
+Run itself when the cleanup ticker fires. The only flow state shared with ReadFromServer is the last used time, which is
+accessed atomically, and the identities sharing the flow, which are guarded by the flow's lock.
+
+Stop ends the session. Run closes every flow's socket and returns, and ReadFromServer goroutines give up on anything
+they were still sending.
+*/
+
 type Proxy struct {
-	Connections   map[string]*net.UDPConn
-	LastUsed      map[string]time.Time
+	Flows         map[string]*Flow
 	PersonaInput  chan *Request
 	PersonaOutput chan *Response
+
+	// Clock is used for flow timeouts. It can be replaced before Run is called.
+	Clock clock.Clock
+
+	failed       chan *readResult
+	syncRequests chan chan struct{}
+
+	done    chan struct{} // closed by Stop
+	stopped sync.Once
+}
+
+// readResult is sent from a ReadFromServer goroutine back to Proxy.Run when reading from a flow's socket fails.
+type readResult struct {
+	flow      *Flow
+	readError error
 }
 
 func New() *Proxy {
-	connections := make(map[string]*net.UDPConn)
-	lastUsed := make(map[string]time.Time)
-	input := make(chan *Request)
+	flows := make(map[string]*Flow)
+	// The input is buffered so that the router can queue up a batch of writes while Run is sending the last one.
+	input := make(chan *Request, BatchSize)
 	output := make(chan *Response)
+	failed := make(chan *readResult)
+	syncRequests := make(chan chan struct{})
+	done := make(chan struct{})
 
-	return &Proxy{connections, lastUsed, input, output}
+	return &Proxy{flows, input, output, clock.Real, failed, syncRequests, done, sync.Once{}}
 }
 
 func (p *Proxy) Run() {
-	go p.Cleanup()
-
 	golog.Debug("udpproxy.Proxy.Run()")
+
+	cleanup := p.Clock.NewTicker(CleanupInterval)
+	defer cleanup.Stop()
+
 	for {
 		golog.Debug("udpproxy.Proxy.Run - main loop")
 		select {
 		case request := <-p.PersonaInput:
 			golog.Debug("udpproxy.Proxy.Run - request received")
-			switch request.Type {
-			case RequestWrite:
-				golog.Debug("udpproxy.Proxy.Run - request is a write")
-				if request.Data == nil || len(request.Data) == 0 {
-					p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, bad write request, no data to write"))
-					continue
-				}
+			p.handleRequests(p.collectRequests(request))
 
-				connection, ok := p.Connections[request.Identity.String()]
-				if !ok {
-					golog.Debug("udpproxy.Proxy.Run - new UDP connection")
-					addr, resolveError := net.ResolveUDPAddr("udp", request.Identity.Destination)
-					if resolveError != nil {
-						p.PersonaOutput <- NewErrorResponse(request.Identity, resolveError)
-						continue
-					}
-					newConnection, dialError := net.DialUDP("udp", nil, addr)
-					connection = newConnection
-
-					if dialError != nil {
-						p.PersonaOutput <- NewErrorResponse(request.Identity, dialError)
-						continue
-					}
-
-					p.Connections[request.Identity.String()] = connection
-					p.LastUsed[request.Identity.String()] = time.Now()
-
-					go p.ReadFromServer(connection, request.Identity, p.PersonaOutput)
-				}
+		case result := <-p.failed:
+			golog.Debug("udpproxy.Proxy.Run - read failed")
+			key := flowKey(result.flow.Identity)
+			if p.Flows[key] != result.flow {
+				continue
+			}
+
+			_ = result.flow.Conn.Close()
+			delete(p.Flows, key)
+			for _, identity := range result.flow.Identities() {
+				p.respond(NewErrorResponse(identity, result.readError))
+			}
+
+		case <-cleanup.C():
+			golog.Debug("udpproxy.Proxy.Run - cleanup")
+			p.cleanup()
+
+		case done := <-p.syncRequests:
+			// A tick that is already waiting is handled first, so that it is finished with too.
+			select {
+			case <-cleanup.C():
+				p.cleanup()
+			default:
+			}
+			close(done)
+
+		case <-p.done:
+			golog.Debug("udpproxy.Proxy.Run - stopped")
+			for key, flow := range p.Flows {
+				_ = flow.Conn.Close()
+				delete(p.Flows, key)
+			}
+			return
+		}
+	}
+}
+
+// Stop closes every flow and stops Run. Nothing more is sent to PersonaOutput once Stop has been called.
+func (p *Proxy) Stop() {
+	p.stopped.Do(func() {
+		close(p.done)
+	})
+}
+
+// respond sends a response to Persona, unless the proxy has been stopped.
+func (p *Proxy) respond(response *Response) {
+	p.send(p.PersonaOutput, response)
+}
+
+// send sends a response on output, unless the proxy has been stopped.
+func (p *Proxy) send(output chan *Response, response *Response) {
+	select {
+	case output <- response:
+	case <-p.done:
+	}
+}
+
+// sync waits until Run has finished with every request and tick that has already been delivered to it. Tests use it
+// after advancing a fake clock, instead of waiting for an arbitrary time.
+func (p *Proxy) sync() {
+	done := make(chan struct{})
+	p.syncRequests <- done
+	<-done
+}
+
+// collectRequests gathers up any other requests that are already waiting, so that writes can be sent as a batch.
+func (p *Proxy) collectRequests(request *Request) []*Request {
+	requests := []*Request{request}
+	for len(requests) < BatchSize {
+		select {
+		case next := <-p.PersonaInput:
+			requests = append(requests, next)
+		default:
+			return requests
+		}
+	}
+
+	return requests
+}
+
+// handleRequests handles a group of requests in order. Writes to connected sockets are held back and sent to each flow as
+// a single batch, which is flushed early if the flow is closed.
+func (p *Proxy) handleRequests(requests []*Request) {
+	pending := make(map[*Flow][]*Request)
+	order := make([]*Flow, 0)
 
-				golog.Debugf("udpproxy.Proxy.Run - writing %d bytes upstream", len(request.Data))
-				bytesWrote, writeError := connection.Write(request.Data)
+	for _, request := range requests {
+		switch request.Type {
+		case RequestWrite:
+			golog.Debug("udpproxy.Proxy.Run - request is a write")
+			if request.Data == nil || len(request.Data) == 0 {
+				p.respond(NewErrorResponse(request.Identity, errors.New("error, bad write request, no data to write")))
+				continue
+			}
+
+			addr, resolveError := net.ResolveUDPAddr("udp", request.Identity.Destination)
+			if resolveError != nil {
+				p.respond(NewErrorResponse(request.Identity, resolveError))
+				continue
+			}
+
+			flow := p.openFlow(request.Identity, addr)
+			if flow == nil {
+				continue
+			}
+
+			flow.touch(p.Clock.Now())
+
+			if FullCone {
+				// Batched writes can't address IPv4 destinations from a dual stack socket, so full cone writes are sent one at a time.
+				_, writeError := flow.Conn.WriteToUDP(request.Data, addr)
 				if writeError != nil {
-					p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, bad write"))
-					continue
+					p.reportWriteError(request.Identity, writeError)
 				}
-				if bytesWrote != len(request.Data) {
-					p.PersonaOutput <- NewErrorResponse(request.Identity, errors.New("error, short write"))
-					continue
-				}
-				golog.Debugf("udpproxy.Proxy.Run - wrote %d bytes upstream", bytesWrote)
+				continue
+			}
+
+			_, ok := pending[flow]
+			if !ok {
+				order = append(order, flow)
+			}
+			pending[flow] = append(pending[flow], request)
+
+		case RequestClose:
+			golog.Debug("udpproxy.Proxy.Run - request is a close")
+			key := flowKey(request.Identity)
+			flow, ok := p.Flows[key]
+			if !ok || !flow.Remove(request.Identity) {
+				p.respond(NewErrorResponse(request.Identity, errors.New("error, Persona is asking us to close a flow that we do not have")))
+				continue
+			}
+
+			// In full cone mode other identities may still be using the socket.
+			if len(flow.Identities()) > 0 {
+				continue
 			}
+
+			p.writeBatch(flow, pending[flow])
+			delete(pending, flow)
+
+			_ = flow.Conn.Close()
+			delete(p.Flows, key)
 		}
 	}
+
+	for _, flow := range order {
+		p.writeBatch(flow, pending[flow])
+	}
 }
 
-func (p *Proxy) ReadFromServer(server *net.UDPConn, identity *ip.Identity, output chan *Response) {
+// openFlow returns the flow for an identity, creating it if there isn't one yet.
+func (p *Proxy) openFlow(identity *ip.Identity, addr *net.UDPAddr) *Flow {
+	key := flowKey(identity)
+	flow, ok := p.Flows[key]
+	if ok {
+		flow.Add(identity)
+		return flow
+	}
+
+	golog.Debug("udpproxy.Proxy.Run - new UDP connection")
+	var connection *net.UDPConn
+	var dialError error
+	if FullCone {
+		connection, dialError = net.ListenUDP("udp", nil)
+	} else {
+		connection, dialError = net.DialUDP("udp", nil, addr)
+	}
+
+	if dialError != nil {
+		p.respond(NewErrorResponse(identity, dialError))
+		return nil
+	}
+
+	flow = NewFlow(identity, connection, p.Clock.Now())
+	p.Flows[key] = flow
+
+	go p.ReadFromServer(flow, p.PersonaOutput)
+
+	return flow
+}
+
+// writeBatch sends write requests to a flow's connected socket with as few system calls as possible.
+func (p *Proxy) writeBatch(flow *Flow, requests []*Request) {
+	if len(requests) == 0 {
+		return
+	}
+
+	messages := make([]ipv4.Message, len(requests))
+	for index, request := range requests {
+		messages[index].Buffers = [][]byte{request.Data}
+	}
+
+	sent := 0
+	for sent < len(messages) {
+		count, writeError := flow.Batch.WriteBatch(messages[sent:], 0)
+		sent = sent + count
+		if writeError != nil {
+			// Report the datagram that failed and carry on with the rest of the batch.
+			p.reportWriteError(requests[sent].Identity, writeError)
+			sent = sent + 1
+		}
+	}
+
+	golog.Debugf("udpproxy.Proxy.Run - wrote %d datagrams upstream", len(messages))
+}
+
+func (p *Proxy) reportWriteError(identity *ip.Identity, writeError error) {
+	reason, ok := unreachableReason(writeError)
+	if ok {
+		p.respond(NewUnreachableResponse(identity, reason))
+		return
+	}
+
+	p.respond(NewErrorResponse(identity, errors.New("error, bad write")))
+}
+
+// flowKey returns the key for the flow that carries datagrams for an identity.
+// In full cone mode all of the identities with the same source share a flow.
+func flowKey(identity *ip.Identity) string {
+	if FullCone {
+		return identity.Source
+	}
+
+	return identity.String()
+}
+
+func (p *Proxy) ReadFromServer(flow *Flow, output chan *Response) {
+	batch := newReadBatch()
+
 	for {
-		length := 2048
-		data := make([]byte, length)
-		dataReadLength, sourceAddress, dataReadError := server.ReadFromUDP(data)
+		count, dataReadError := flow.Batch.ReadBatch(batch.messages, 0)
 		if dataReadError != nil {
-			output <- NewErrorResponse(identity, dataReadError)
-			_ = server.Close()
-			delete(p.Connections, identity.String())
-			delete(p.LastUsed, identity.String())
+			// The flow was closed by Persona or by cleanup, which have already removed it.
+			if errors.Is(dataReadError, net.ErrClosed) {
+				return
+			}
+
+			reason, ok := unreachableReason(dataReadError)
+			if ok {
+				for _, identity := range flow.Identities() {
+					p.send(output, NewUnreachableResponse(identity, reason))
+				}
+				continue
+			}
+
+			select {
+			case p.failed <- &readResult{flow, dataReadError}:
+			case <-p.done:
+			}
 			return
 		}
-		if dataReadLength != length {
-			data = data[:dataReadLength]
+
+		flow.touch(p.Clock.Now())
+
+		grow := false
+		for _, message := range batch.messages[:count] {
+			if truncated(message) {
+				golog.Debugf("dropping a UDP datagram that was larger than the %d byte receive buffer", batch.size)
+				grow = true
+				continue
+			}
+
+			data := make([]byte, message.N)
+			copy(data, message.Buffers[0][:message.N])
+
+			p.deliver(flow, message.Addr, data, output)
 		}
 
-		if sourceAddress.String() != identity.Destination {
-			golog.Debugf("source of incoming UDP packet %v does not match connection Identity %v", sourceAddress.String(), identity.Destination)
-			continue
+		if grow {
+			batch.grow()
 		}
+		batch.resize(count)
+	}
+}
+
+// deliver sends a datagram read from a flow's socket to Persona.
+func (p *Proxy) deliver(flow *Flow, sourceAddress net.Addr, data []byte, output chan *Response) {
+	// Connected sockets only receive datagrams from the identity's destination.
+	if sourceAddress == nil {
+		p.send(output, NewDataResponse(flow.Identity, data))
+		return
+	}
+
+	identity, matched := flow.route(sourceAddress.String())
+	if identity == nil {
+		return
+	}
+
+	if matched {
+		p.send(output, NewDataResponse(identity, data))
+		return
+	}
+
+	if !FullCone {
+		golog.Debugf("source of incoming UDP packet %v does not match connection Identity %v", sourceAddress.String(), identity.Destination)
+		return
+	}
 
-		output <- NewDataResponse(identity, data)
+	response, responseError := NewDataFromResponse(identity, sourceAddress.String(), data)
+	if responseError != nil {
+		golog.Debugf("error encoding source of incoming UDP packet %v - %v", sourceAddress.String(), responseError)
+		return
 	}
+
+	p.send(output, response)
 }
 
-func (p *Proxy) Cleanup() {
-	for {
-		timer := time.NewTimer(60 * time.Second) // 60 seconds
-
-		<-timer.C // wait on timer channel to fire
-
-		now := time.Now()
-
-		for identityString, lastUsed := range p.LastUsed {
-			if now.Sub(lastUsed).Seconds() > 60 {
-				golog.Debugf("closing old connection %v", identityString)
-				connection, ok := p.Connections[identityString]
-				if ok {
-					_ = connection.Close()
-					delete(p.Connections, identityString)
-					delete(p.LastUsed, identityString)
-				} else {
-					golog.Debug("error, lastUsed out of sync with connections")
-				}
+// cleanup closes flows that have gone unused for longer than their timeout, and tells Persona that they are gone.
+func (p *Proxy) cleanup() {
+	now := p.Clock.Now()
+
+	for key, flow := range p.Flows {
+		if now.Sub(flow.LastUsed()) > flow.Timeout {
+			golog.Debugf("closing old connection %v", key)
+			_ = flow.Conn.Close()
+			delete(p.Flows, key)
+			for _, identity := range flow.Identities() {
+				p.respond(NewCloseResponse(identity))
 			}
 		}
 	}
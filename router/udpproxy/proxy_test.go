@@ -0,0 +1,462 @@
+package udpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"router/clock"
+	"router/ip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a UDP server that sends every datagram back to where it came from.
+func startEchoServer(t testing.TB) *net.UDPConn {
+	server, listenError := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+
+	go func() {
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			bytesRead, source, readError := server.ReadFromUDP(buffer)
+			if readError != nil {
+				return
+			}
+
+			_, _ = server.WriteToUDP(buffer[:bytesRead], source)
+		}
+	}()
+
+	return server
+}
+
+func newTestIdentity(t testing.TB, source string, destination string) *ip.Identity {
+	identity, identityError := ip.NewIdentityFromString(source + ":" + destination)
+	if identityError != nil {
+		t.Fatal(identityError)
+	}
+
+	return identity
+}
+
+// nextResponse waits for the next response from the proxy. It returns nil if there isn't one within a reasonable time.
+func nextResponse(t testing.TB, proxy *Proxy) *Response {
+	select {
+	case response := <-proxy.PersonaOutput:
+		return response
+	case <-time.After(10 * time.Second):
+		t.Error("timed out waiting for a response")
+		return nil
+	}
+}
+
+// TestFullConeSharedFlow checks that closing one of the identities that share a full cone flow leaves the flow working
+// for the others.
+func TestFullConeSharedFlow(t *testing.T) {
+	FullCone = true
+	defer func() {
+		FullCone = false
+	}()
+
+	first := startEchoServer(t)
+	defer first.Close()
+	second := startEchoServer(t)
+	defer second.Close()
+
+	proxy := New()
+	go proxy.Run()
+
+	firstIdentity := newTestIdentity(t, "10.0.0.1:5000", first.LocalAddr().String())
+	secondIdentity := newTestIdentity(t, "10.0.0.1:5000", second.LocalAddr().String())
+
+	proxy.PersonaInput <- &Request{RequestWrite, firstIdentity, []byte("first")}
+	response := nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseData || response.Identity.String() != firstIdentity.String() {
+		t.Fatalf("expected data for %s, got %v", firstIdentity.String(), response)
+	}
+
+	proxy.PersonaInput <- &Request{RequestWrite, secondIdentity, []byte("second")}
+	response = nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseData || response.Identity.String() != secondIdentity.String() {
+		t.Fatalf("expected data for %s, got %v", secondIdentity.String(), response)
+	}
+
+	proxy.PersonaInput <- &Request{RequestClose, firstIdentity, nil}
+	proxy.PersonaInput <- &Request{RequestWrite, secondIdentity, []byte("again")}
+	response = nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseData || string(response.Payload) != "again" {
+		t.Fatalf("expected the shared flow to still carry data, got %v", response)
+	}
+
+	proxy.PersonaInput <- &Request{RequestClose, secondIdentity, nil}
+	proxy.PersonaInput <- &Request{RequestClose, secondIdentity, nil}
+	response = nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseError {
+		t.Fatalf("expected an error for closing a flow twice, got %v", response)
+	}
+}
+
+// TestLargeDatagram checks that a flow switches to larger receive buffers after a datagram that doesn't fit, so that
+// later datagrams of that size are delivered whole.
+func TestLargeDatagram(t *testing.T) {
+	server := startEchoServer(t)
+	defer server.Close()
+
+	proxy := New()
+	go proxy.Run()
+
+	identity := newTestIdentity(t, "10.0.0.1:5000", server.LocalAddr().String())
+	large := make([]byte, 8*MinReadSize)
+
+	// The first large datagram is dropped, so the small one is the first to come back.
+	proxy.PersonaInput <- &Request{RequestWrite, identity, large}
+	proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+	response := nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseData || string(response.Payload) != "hello" {
+		t.Fatalf("expected the small datagram, got %v", response)
+	}
+
+	proxy.PersonaInput <- &Request{RequestWrite, identity, large}
+	response = nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseData || len(response.Payload) != len(large) {
+		t.Fatalf("expected a %d byte datagram, got %v", len(large), response)
+	}
+}
+
+// TestStop checks that stopping the proxy closes every flow, even when a flow's reader is waiting to deliver a datagram
+// that nobody is going to take.
+func TestStop(t *testing.T) {
+	server := startEchoServer(t)
+	defer server.Close()
+
+	proxy := New()
+	finished := make(chan struct{})
+	go func() {
+		proxy.Run()
+		close(finished)
+	}()
+
+	identity := newTestIdentity(t, "10.0.0.1:5000", server.LocalAddr().String())
+	proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+	response := nextResponse(t, proxy)
+	if response == nil || response.Type != ResponseData {
+		t.Fatalf("expected data, got %v", response)
+	}
+
+	// This time nothing takes the echoed datagram.
+	proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+	proxy.sync()
+	flow := proxy.Flows[flowKey(identity)]
+
+	proxy.Stop()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+
+	if len(proxy.Flows) != 0 {
+		t.Errorf("expected no flows after Stop, got %d", len(proxy.Flows))
+	}
+
+	if _, writeError := flow.Conn.Write([]byte("hello")); !errors.Is(writeError, net.ErrClosed) {
+		t.Errorf("expected the flow's socket to be closed, got %v", writeError)
+	}
+}
+
+// collect moves every response from the proxy onto a large buffered channel, so that the proxy never waits for the test.
+func collect(proxy *Proxy) chan *Response {
+	responses := make(chan *Response, 100000)
+	go func() {
+		for response := range proxy.PersonaOutput {
+			responses <- response
+		}
+	}()
+
+	return responses
+}
+
+// newFakeClockProxy starts a proxy with a fake clock. Its output is buffered, so that once sync has returned every
+// response that Run has sent is waiting there.
+func newFakeClockProxy() (*Proxy, *clock.Fake) {
+	fake := clock.NewFake(time.Unix(1000, 0))
+	proxy := New()
+	proxy.Clock = fake
+	proxy.PersonaOutput = make(chan *Response, 100000)
+	go proxy.Run()
+
+	return proxy, fake
+}
+
+// drain discards responses until none have arrived for a while, which is as long as it takes for echoes that are still
+// on their way to come back.
+func drain(responses chan *Response) {
+	for {
+		select {
+		case <-responses:
+		case <-time.After(200 * time.Millisecond):
+			return
+		}
+	}
+}
+
+// TestStress writes to and closes many flows at the same time, while the clock moves quickly enough for flows to expire
+// in the middle of it all. It is meant to be run with -race.
+func TestStress(t *testing.T) {
+	server := startEchoServer(t)
+	defer server.Close()
+
+	proxy, fake := newFakeClockProxy()
+	responses := proxy.PersonaOutput
+
+	stopAdvancing := make(chan struct{})
+	advancing := sync.WaitGroup{}
+	advancing.Add(1)
+	go func() {
+		defer advancing.Done()
+		for {
+			select {
+			case <-stopAdvancing:
+				return
+			case <-time.After(time.Millisecond):
+				fake.Advance(CleanupInterval)
+			}
+		}
+	}()
+
+	identities := make([]*ip.Identity, 0)
+	for client := 0; client < 20; client++ {
+		for flow := 0; flow < 5; flow++ {
+			identities = append(identities, newTestIdentity(t, fmt.Sprintf("10.0.%d.%d:%d", client, flow, 1000+flow), server.LocalAddr().String()))
+		}
+	}
+
+	var wait sync.WaitGroup
+	for client := 0; client < 20; client++ {
+		wait.Add(1)
+		go func(client int) {
+			defer wait.Done()
+
+			for index := 0; index < 100; index++ {
+				identity := identities[client*5+index%5]
+				proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+				if index%7 == 0 {
+					proxy.PersonaInput <- &Request{RequestClose, identity, nil}
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(client)
+	}
+
+	wait.Wait()
+	close(stopAdvancing)
+	advancing.Wait()
+
+	// Once everything has gone quiet, expire whatever is left. Every flow should then be gone.
+	drain(responses)
+	fake.Advance(DefaultTimeout + CleanupInterval)
+	proxy.sync()
+	for len(responses) > 0 {
+		<-responses
+	}
+
+	for _, identity := range identities {
+		proxy.PersonaInput <- &Request{RequestClose, identity, nil}
+
+		select {
+		case response := <-responses:
+			if response.Type != ResponseError || response.Identity.String() != identity.String() {
+				t.Errorf("%s: expected an error for closing an expired flow, got %v", identity.String(), response.Type)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: timed out waiting for a response", identity.String())
+		}
+	}
+}
+
+// advanceUntilClosed moves the clock on one cleanup interval at a time until every identity has been sent a close
+// response. It returns how far the clock had moved when each identity was closed.
+func advanceUntilClosed(t testing.TB, proxy *Proxy, fake *clock.Fake, identities []*ip.Identity, limit time.Duration) map[string]time.Duration {
+	start := fake.Now()
+	closed := make(map[string]time.Duration)
+	for len(closed) < len(identities) {
+		if fake.Now().Sub(start) > limit {
+			t.Fatalf("only %d of %d flows were closed within %v", len(closed), len(identities), limit)
+		}
+
+		fake.Advance(CleanupInterval)
+		proxy.sync()
+
+		for len(proxy.PersonaOutput) > 0 {
+			response := <-proxy.PersonaOutput
+			if response.Type != ResponseClose {
+				t.Fatalf("expected a close response, got %v", response.Type)
+			}
+			closed[response.Identity.String()] = fake.Now().Sub(start)
+		}
+	}
+
+	return closed
+}
+
+// TestPortTimeouts checks that flows expire after the timeout for their destination port and that Persona is told.
+func TestPortTimeouts(t *testing.T) {
+	short := startEchoServer(t)
+	defer short.Close()
+	long := startEchoServer(t)
+	defer long.Close()
+
+	shortPort := uint16(short.LocalAddr().(*net.UDPAddr).Port)
+	PortTimeouts[shortPort] = 15 * time.Second
+
+	proxy, fake := newFakeClockProxy()
+
+	shortIdentity := newTestIdentity(t, "10.0.0.1:5000", short.LocalAddr().String())
+	longIdentity := newTestIdentity(t, "10.0.0.1:5001", long.LocalAddr().String())
+	for _, identity := range []*ip.Identity{shortIdentity, longIdentity} {
+		proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+		response := nextResponse(t, proxy)
+		if response == nil || response.Type != ResponseData {
+			t.Fatalf("expected data, got %v", response)
+		}
+	}
+
+	closed := advanceUntilClosed(t, proxy, fake, []*ip.Identity{shortIdentity, longIdentity}, 2*DefaultTimeout)
+
+	// Run has finished with PortTimeouts once it has closed the flows.
+	delete(PortTimeouts, shortPort)
+
+	if elapsed := closed[shortIdentity.String()]; elapsed <= 15*time.Second || elapsed > 15*time.Second+2*CleanupInterval {
+		t.Errorf("expected the flow to port %d to close after 15s, it closed after %v", shortPort, elapsed)
+	}
+	if elapsed := closed[longIdentity.String()]; elapsed <= DefaultTimeout || elapsed > DefaultTimeout+2*CleanupInterval {
+		t.Errorf("expected the flow with the default timeout to close after %v, it closed after %v", DefaultTimeout, elapsed)
+	}
+}
+
+// TestFullConeExpiry checks that every identity sharing a full cone flow is told when it expires.
+func TestFullConeExpiry(t *testing.T) {
+	FullCone = true
+	defer func() {
+		FullCone = false
+	}()
+
+	first := startEchoServer(t)
+	defer first.Close()
+	second := startEchoServer(t)
+	defer second.Close()
+
+	proxy, fake := newFakeClockProxy()
+
+	identities := []*ip.Identity{
+		newTestIdentity(t, "10.0.0.1:5000", first.LocalAddr().String()),
+		newTestIdentity(t, "10.0.0.1:5000", second.LocalAddr().String()),
+	}
+	for _, identity := range identities {
+		proxy.PersonaInput <- &Request{RequestWrite, identity, []byte("hello")}
+		response := nextResponse(t, proxy)
+		if response == nil || response.Type != ResponseData {
+			t.Fatalf("expected data, got %v", response)
+		}
+	}
+
+	advanceUntilClosed(t, proxy, fake, identities, 2*DefaultTimeout)
+}
+
+// startSink starts a UDP server that discards everything it receives.
+func startSink(t testing.TB) *net.UDPConn {
+	server, listenError := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+
+	go func() {
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			_, _, readError := server.ReadFromUDP(buffer)
+			if readError != nil {
+				return
+			}
+		}
+	}()
+
+	return server
+}
+
+// BenchmarkWrite measures how many datagrams per second the proxy can send upstream for one flow.
+func BenchmarkWrite(b *testing.B) {
+	server := startSink(b)
+	defer server.Close()
+
+	proxy := New()
+	go proxy.Run()
+	responses := collect(proxy)
+
+	identity := newTestIdentity(b, "10.0.0.1:5000", server.LocalAddr().String())
+	payload := make([]byte, 512)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for index := 0; index < b.N; index++ {
+		proxy.PersonaInput <- &Request{RequestWrite, identity, payload}
+	}
+
+	// Closing the flow sends anything still waiting to be written. Closing it again can only be answered once that is done.
+	proxy.PersonaInput <- &Request{RequestClose, identity, nil}
+	proxy.PersonaInput <- &Request{RequestClose, identity, nil}
+	select {
+	case <-responses:
+	case <-time.After(10 * time.Second):
+		b.Fatal("timed out waiting for the writes to finish")
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+// BenchmarkEcho measures how many datagrams per second make it to an echo server and back, with a window of
+// datagrams in flight.
+func BenchmarkEcho(b *testing.B) {
+	server := startEchoServer(b)
+	defer server.Close()
+
+	proxy := New()
+	go proxy.Run()
+	responses := collect(proxy)
+
+	identity := newTestIdentity(b, "10.0.0.1:5000", server.LocalAddr().String())
+	payload := make([]byte, 512)
+
+	const window = 32
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	sent := 0
+	for ; sent < b.N && sent < window; sent++ {
+		proxy.PersonaInput <- &Request{RequestWrite, identity, payload}
+	}
+
+	for received := 0; received < b.N; received++ {
+		select {
+		case response := <-responses:
+			if response.Type != ResponseData {
+				b.Fatalf("expected data, got %v", response.Type)
+			}
+		case <-time.After(10 * time.Second):
+			b.Fatalf("timed out after %d of %d datagrams, one was probably dropped", received, b.N)
+		}
+
+		if sent < b.N {
+			proxy.PersonaInput <- &Request{RequestWrite, identity, payload}
+			sent++
+		}
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
@@ -6,6 +6,7 @@ type RequestType byte
 
 const (
 	RequestWrite RequestType = 2
+	RequestClose RequestType = 3
 )
 
 type Request struct {
@@ -15,20 +16,23 @@ type Request struct {
 }
 
 func NewRequest(data []byte) *Request {
-	if len(data) < 13 {
+	if len(data) < 1 {
 		return nil
 	}
 
 	typeByte := data[0]
-	identityBytes := data[1:13]
-	rest := data[13:]
+	identity, rest := ip.SplitIdentity(data[1:])
+	if identity == nil {
+		return nil
+	}
 
 	requestType := RequestType(typeByte)
-	identity := ip.NewIdentity(identityBytes)
 
 	switch requestType {
 	case RequestWrite:
 		return &Request{requestType, identity, rest}
+	case RequestClose:
+		return &Request{requestType, identity, nil}
 	default:
 		return nil
 	}
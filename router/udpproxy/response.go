@@ -6,7 +6,15 @@ type ResponseType byte
 
 const (
 	ResponseData  ResponseType = 1
+	ResponseClose ResponseType = 2
 	ResponseError ResponseType = 3
+
+	// ResponseDataFrom is sent in full cone mode for datagrams that come from somewhere other than the identity's destination.
+	// The payload starts with the source of the datagram, encoded as an address family byte followed by the host and port.
+	ResponseDataFrom ResponseType = 4
+
+	// ResponseUnreachable reports an ICMP error for a flow. The payload is a single UnreachableReason byte.
+	ResponseUnreachable ResponseType = 5
 )
 
 type Response struct {
@@ -20,6 +28,27 @@ func NewDataResponse(identity *ip.Identity, payload []byte) *Response {
 	return &Response{ResponseData, identity, payload, nil}
 }
 
+func NewDataFromResponse(identity *ip.Identity, source string, payload []byte) (*Response, error) {
+	sourceBytes, sourceError := ip.StringToTaggedAddressBytes(source)
+	if sourceError != nil {
+		return nil, sourceError
+	}
+
+	result := make([]byte, 0)
+	result = append(result, sourceBytes...)
+	result = append(result, payload...)
+	return &Response{ResponseDataFrom, identity, result, nil}, nil
+}
+
+// NewCloseResponse tells Persona that a flow has been closed because it was not used for too long.
+func NewCloseResponse(identity *ip.Identity) *Response {
+	return &Response{ResponseClose, identity, nil, nil}
+}
+
+func NewUnreachableResponse(identity *ip.Identity, reason UnreachableReason) *Response {
+	return &Response{ResponseUnreachable, identity, []byte{byte(reason)}, nil}
+}
+
 func NewErrorResponse(identity *ip.Identity, responseError error) *Response {
 	return &Response{ResponseError, identity, nil, responseError}
 }
@@ -38,6 +67,14 @@ func (r *Response) Data() ([]byte, error) {
 		if r.Payload != nil {
 			result = append(result, r.Payload...)
 		}
+	case ResponseDataFrom:
+		if r.Payload != nil {
+			result = append(result, r.Payload...)
+		}
+	case ResponseUnreachable:
+		if r.Payload != nil {
+			result = append(result, r.Payload...)
+		}
 	case ResponseError:
 		if r.Error != nil {
 			result = append(result, []byte(r.Error.Error())...)
@@ -0,0 +1,60 @@
+package udpproxy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long a UDP flow can go unused before it is closed, for ports without an entry in PortTimeouts.
+var DefaultTimeout = 60 * time.Second
+var CleanupInterval = 5 * time.Second
+
+var PortTimeouts = map[uint16]time.Duration{
+	53:    15 * time.Second, // DNS
+	123:   15 * time.Second, // NTP
+	443:   5 * time.Minute,  // QUIC
+	500:   5 * time.Minute,  // IKE
+	4500:  5 * time.Minute,  // IPsec NAT traversal
+	51820: 5 * time.Minute,  // WireGuard
+}
+
+// TimeoutForPort returns the idle timeout for flows to port.
+func TimeoutForPort(port uint16) time.Duration {
+	timeout, ok := PortTimeouts[port]
+	if ok {
+		return timeout
+	}
+
+	return DefaultTimeout
+}
+
+// SetPortTimeouts parses a comma separated list of port=duration pairs, for instance 53=10s,443=10m, into PortTimeouts.
+func SetPortTimeouts(timeouts string) error {
+	for _, pair := range strings.Split(timeouts, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return errors.New("error, port timeout did not contain = separator")
+		}
+
+		port, portError := strconv.ParseUint(parts[0], 10, 16)
+		if portError != nil {
+			return portError
+		}
+
+		timeout, timeoutError := time.ParseDuration(parts[1])
+		if timeoutError != nil {
+			return timeoutError
+		}
+
+		PortTimeouts[uint16(port)] = timeout
+	}
+
+	return nil
+}
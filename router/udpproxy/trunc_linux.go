@@ -0,0 +1,8 @@
+//go:build linux
+
+package udpproxy
+
+import "syscall"
+
+// msgTrunc is the flag that recvmmsg sets on a datagram that was too large for its buffer.
+const msgTrunc = syscall.MSG_TRUNC
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package udpproxy
+
+// msgTrunc is 0 where ReadBatch doesn't report message flags, so truncation can only be guessed from a full buffer.
+const msgTrunc = 0
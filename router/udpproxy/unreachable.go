@@ -0,0 +1,38 @@
+package udpproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+/*
+The kernel reports ICMP errors for a connected UDP socket as errors on the next read or write. These don't mean that
+the flow is broken, the remote may simply not be listening yet, so the flow is kept open and Persona is sent a
+ResponseUnreachable with the reason, so that it can send the matching ICMP message to the client.
+*/
+
+type UnreachableReason byte
+
+const (
+	UnreachableUnknown       UnreachableReason = 0
+	UnreachablePort          UnreachableReason = 1
+	UnreachableHost          UnreachableReason = 2
+	UnreachableNetwork       UnreachableReason = 3
+	UnreachableMessageTooBig UnreachableReason = 4
+)
+
+// unreachableReason checks whether an error came from an ICMP error, and if so which one.
+func unreachableReason(socketError error) (UnreachableReason, bool) {
+	switch {
+	case errors.Is(socketError, syscall.ECONNREFUSED):
+		return UnreachablePort, true
+	case errors.Is(socketError, syscall.EHOSTUNREACH):
+		return UnreachableHost, true
+	case errors.Is(socketError, syscall.ENETUNREACH):
+		return UnreachableNetwork, true
+	case errors.Is(socketError, syscall.EMSGSIZE):
+		return UnreachableMessageTooBig, true
+	default:
+		return UnreachableUnknown, false
+	}
+}